@@ -3,11 +3,13 @@ package maya
 import (
    "41.neocities.org/luna/dash"
    "41.neocities.org/luna/hls"
+   "crypto/rsa"
    "errors"
    "io"
    "log"
    "net/http"
    "net/url"
+   "time"
 )
 
 func DownloadDash(streamId string, manifestData *Manifest, optionsData *Options) error {
@@ -20,12 +22,12 @@ func DownloadDash(streamId string, manifestData *Manifest, optionsData *Options)
       return err
    }
 
-   kFetcher, err := optionsData.getKeyFetcher()
+   kFetcher, err := optionsData.getKeyFetcher(streamId)
    if err != nil {
       return err
    }
 
-   return downloadDash(mpd, optionsData.Threads, optionsData.MinBitrate, streamId, kFetcher)
+   return downloadDash(mpd, manifestData, streamId, optionsData, kFetcher)
 }
 
 func DownloadHls(streamId string, manifestData *Manifest, optionsData *Options) error {
@@ -38,12 +40,12 @@ func DownloadHls(streamId string, manifestData *Manifest, optionsData *Options)
       return err
    }
 
-   kFetcher, err := optionsData.getKeyFetcher()
+   kFetcher, err := optionsData.getKeyFetcher(streamId)
    if err != nil {
       return err
    }
 
-   return downloadHls(playlist, optionsData.Threads, optionsData.MinBitrate, streamId, kFetcher)
+   return downloadHls(playlist, manifestData, streamId, optionsData, kFetcher)
 }
 
 func fetchData(targetUrl *url.URL, headers map[string]string, logReq bool) ([]byte, error) {
@@ -73,12 +75,49 @@ func fetchData(targetUrl *url.URL, headers map[string]string, logReq bool) ([]by
    return io.ReadAll(resp.Body)
 }
 
+// ContentKey is a KID and key pair obtained from a license or key source.
+type ContentKey struct {
+   KeyId []byte
+   Key   []byte
+}
+
+// DrmBackend performs license exchanges for one DRM system. A backend may
+// serve concurrent downloads, so the state of each exchange is kept in the
+// DrmExchange returned with its challenge.
+type DrmBackend interface {
+   // LicenseRequest builds the license challenge for a key and content ID.
+   LicenseRequest(keyId, contentId []byte) ([]byte, DrmExchange, error)
+}
+
+// DrmExchange reads the license sent in response to one challenge. The
+// response is parsed, then the keys extracted, in that order.
+type DrmExchange interface {
+   // ParseLicense decodes the license server response to the challenge.
+   ParseLicense(response []byte) error
+   // Keys returns every content key of the parsed license. The built-in
+   // PlayReady backend returns only the requested one.
+   Keys() ([]ContentKey, error)
+}
+
+// DrmCertifier is implemented by backends that obtain a service
+// certificate from the license server before requesting a license.
+type DrmCertifier interface {
+   // CertificateRequest returns the certificate request message, or nil if
+   // no certificate is needed.
+   CertificateRequest() []byte
+   // SetCertificate verifies and stores the certificate response.
+   SetCertificate(response []byte) error
+}
+
 type DrmSystem int
 
 const (
    DrmNone DrmSystem = iota
    DrmPlayReady
    DrmWidevine
+   // DrmKeys decrypts with known keys from Options.Keys or Options.KeyFile
+   // without any license exchange.
+   DrmKeys
 )
 
 type Manifest struct {
@@ -86,6 +125,15 @@ type Manifest struct {
    Body []byte
 }
 
+// FetchManifest fetches a DASH manifest or HLS master playlist.
+func FetchManifest(baseUrl *url.URL) (*Manifest, error) {
+   body, err := fetchData(baseUrl, nil, true)
+   if err != nil {
+      return nil, err
+   }
+   return &Manifest{Url: baseUrl, Body: body}, nil
+}
+
 func ListDash(baseUrl *url.URL) (*Manifest, error) {
    body, err := fetchData(baseUrl, nil, true)
    if err != nil {
@@ -131,6 +179,59 @@ type Options struct {
    Device     string
    License    func([]byte) ([]byte, error)
    MinBitrate int
+   // Backend, if set, replaces the built-in backend of Drm, for example
+   // with a remote CDM service. Drm may be left as DrmNone. Cached keys
+   // are kept apart for each backend type.
+   Backend DrmBackend
+   // PrivacyMode encrypts the Widevine client identification with the
+   // service certificate of the license server, which is requested unless
+   // ServiceCertificate is set. The certificate must verify with RootKey,
+   // the Widevine root public key.
+   PrivacyMode        bool
+   ServiceCertificate []byte
+   RootKey            *rsa.PublicKey
+   // Transport, if set, is used instead of License and wraps each
+   // challenge with the context of the exchange.
+   Transport *LicenseTransport
+   // Result, if set, collects the keys used by each download.
+   Result *DownloadResult
+   // Keys maps hex key IDs to hex content keys for DrmKeys.
+   Keys map[string]string
+   // KeyFile is a file of KID:KEY lines for DrmKeys.
+   KeyFile string
+   // Cache, if set, persists license keys by KID so repeated downloads
+   // only contact the license server on a miss.
+   Cache Cache
+   // KeyLifetime limits how long a cached key is reused. Zero keeps keys
+   // indefinitely.
+   KeyLifetime time.Duration
+   // SkipAds leaves out DASH periods that do not carry the requested
+   // stream, such as inserted ads. By default they are filled with the
+   // closest matching stream, so ad content is included in the output.
+   SkipAds bool
+   // Start and End limit the download to the segments overlapping a time
+   // range. Whole segments are kept, so the output may begin up to one
+   // segment before Start and end up to one segment after End; its first
+   // segment starts at zero. A zero End means the end of the stream.
+   Start time.Duration
+   End   time.Duration
+   // SpreadCdn starts each DASH segment on a CDN picked by the DVB weight
+   // of its BaseURL, rather than the first one. Either way, failed
+   // segments are retried on the other BaseURLs.
+   SpreadCdn bool
+   // RemuxTs converts HLS streams with MPEG-TS segments to fragmented MP4,
+   // the same output as fMP4 streams. H.264, HEVC, AAC and AC-3 are
+   // supported. Segments muxing several streams are written as one file
+   // per stream, video as .mp4 and audio as .m4a. Encrypted segments are
+   // rejected.
+   RemuxTs bool
+   // SubtitleFormat is the output of subtitle streams, "vtt" or "srt".
+   // WebVTT, TTML and fMP4 wvtt and stpp streams are decoded and written
+   // as one file. Empty means "vtt".
+   SubtitleFormat string
+   // obtained keeps every license key for as long as the Options, so the
+   // tracks of a title downloaded with the same Options share one exchange.
+   obtained keyStore
 }
 
 // api.go
@@ -0,0 +1,69 @@
+package maya
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+)
+
+// findBoxes walks the box tree of data along path and returns every box
+// matching the final element. Each intermediate element must be a plain
+// container box.
+func findBoxes(data []byte, path ...string) []mp4Box {
+   if len(path) == 0 {
+      return nil
+   }
+   boxes, err := readBoxes(data)
+   if err != nil {
+      return nil
+   }
+   var matches []mp4Box
+   for _, box := range boxes {
+      if box.Type != path[0] {
+         continue
+      }
+      if len(path) == 1 {
+         matches = append(matches, box)
+      } else {
+         matches = append(matches, findBoxes(box.Payload, path[1:]...)...)
+      }
+   }
+   return matches
+}
+
+// readBoxes splits data into consecutive ISO BMFF boxes.
+func readBoxes(data []byte) ([]mp4Box, error) {
+   var boxes []mp4Box
+   for len(data) > 0 {
+      if len(data) < 8 {
+         return nil, errors.New("truncated box header")
+      }
+      size := uint64(binary.BigEndian.Uint32(data))
+      boxType := string(data[4:8])
+      header := uint64(8)
+      switch size {
+      case 0:
+         size = uint64(len(data))
+      case 1:
+         if len(data) < 16 {
+            return nil, errors.New("truncated largesize box header")
+         }
+         size = binary.BigEndian.Uint64(data[8:])
+         header = 16
+      }
+      if size < header || size > uint64(len(data)) {
+         return nil, fmt.Errorf("invalid size %d for box %q", size, boxType)
+      }
+      boxes = append(boxes, mp4Box{Type: boxType, Payload: data[header:size]})
+      data = data[size:]
+   }
+   return boxes, nil
+}
+
+// mp4Box is a single ISO BMFF box with the header stripped from its payload.
+type mp4Box struct {
+   Type    string
+   Payload []byte
+}
+
+// boxes.go
@@ -0,0 +1,65 @@
+package main
+
+import (
+   "41.neocities.org/maya"
+   "errors"
+   "fmt"
+   "log"
+   "net/url"
+   "os"
+)
+
+func main() {
+   log.SetFlags(log.Ltime)
+   var dash, hls maya.FlagString
+   set := maya.FlagSet{
+      {Name: "dash", Usage: "DASH manifest URL", Value: &dash},
+      {Name: "hls", Usage: "HLS master playlist URL", Value: &hls},
+   }
+   err := set.Parse(os.Args[1:])
+   if err == nil {
+      err = inspect(set, dash, hls)
+   }
+   if err != nil {
+      log.Fatal(err)
+   }
+}
+
+// inspect prints the DRM systems, KIDs, content IDs, PSSH boxes and
+// encryption scheme of every stream, without fetching media segments.
+func inspect(set maya.FlagSet, dash, hls maya.FlagString) error {
+   var address string
+   var inspectFunc func(*maya.Manifest) ([]*maya.StreamProtection, error)
+   switch {
+   case set.IsSet(&dash):
+      address, inspectFunc = string(dash), maya.InspectDash
+   case set.IsSet(&hls):
+      address, inspectFunc = string(hls), maya.InspectHls
+   default:
+      if err := set.Usage(os.Stderr, "inspect"); err != nil {
+         return err
+      }
+      return errors.New("a dash or hls URL is required")
+   }
+   manifestUrl, err := url.Parse(address)
+   if err != nil {
+      return err
+   }
+   manifestData, err := maya.FetchManifest(manifestUrl)
+   if err != nil {
+      return err
+   }
+   streams, err := inspectFunc(manifestData)
+   if err != nil {
+      return err
+   }
+   for index, stream := range streams {
+      if index > 0 {
+         fmt.Println()
+      }
+      fmt.Println(stream)
+   }
+   return nil
+}
+
+// main.go
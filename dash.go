@@ -3,11 +3,13 @@ package maya
 import (
    "41.neocities.org/luna/dash"
    "fmt"
+   "log"
    "slices"
+   "strings"
 )
 
 // downloadDash parses a DASH manifest, extracts all necessary data, and passes it to the central orchestrator.
-func downloadDash(mpd *dash.Mpd, threads, minBitrate int, streamId string, fetchKey keyFetcher) error {
+func downloadDash(mpd *dash.Mpd, manifestData *Manifest, streamId string, optionsData *Options, fetchKey keyFetcher) error {
    dashGroup, ok := mpd.GetRepresentations()[streamId]
    if !ok {
       return fmt.Errorf("representation group not found %v", streamId)
@@ -15,31 +17,62 @@ func downloadDash(mpd *dash.Mpd, threads, minBitrate int, streamId string, fetch
    if len(dashGroup) == 0 {
       return fmt.Errorf("representation group is empty")
    }
-   rep := dashGroup[0]
+   periods := getDashPeriods(mpd, dashGroup, optionsData.SkipAds)
+   if len(periods) == 0 {
+      return fmt.Errorf("no periods left for %v", streamId)
+   }
+   rep := periods[0]
    info, err := detectDashType(rep)
    if err != nil {
       return err
    }
-   var sidxData []byte
-   if rep.SegmentBase != nil {
-      baseUrl, err := rep.ResolveBaseUrl()
-      if err != nil {
-         return err
-      }
-      sidxData, err = fetchData(baseUrl, map[string]string{"Range": "bytes=" + rep.SegmentBase.IndexRange}, true)
-      if err != nil {
-         return fmt.Errorf("failed to pre-fetch sidx data: %w", err)
-      }
-   }
-   allRequests, err := getDashMediaRequests(dashGroup, sidxData)
+   bases := parseDashBaseUrls(manifestData.Body, manifestData.Url)
+   allRequests, sources, err := getDashMediaRequests(
+      mpd, periods, parseDashPeriodStarts(manifestData.Body), bases,
+   )
    if err != nil {
       return err
    }
-   initData, err := getDashInitSegment(rep, info)
+   // each period has its own BaseURLs
+   for start := 0; start < len(allRequests); {
+      period := allRequests[start].period
+      end := start + 1
+      for end < len(allRequests) && allRequests[end].period == period {
+         end++
+      }
+      applyBaseUrls(allRequests[start:end], bases.urls(mpd, periods[period]), optionsData.SpreadCdn)
+      start = end
+   }
+   initData, err := getDashInitSegment(rep, info, bases.urls(mpd, rep))
    if err != nil {
       return err
    }
-   protection, err := getDashProtection(rep)
+   if len(periods) > 1 && info.IsFmp4 {
+      sources[0].init = initData
+      entries, err := sampleEntries(initData)
+      if err != nil {
+         return err
+      }
+      for index, periodRep := range periods[1:] {
+         periodInit, err := getDashInitSegment(periodRep, info, bases.urls(mpd, periodRep))
+         if err != nil {
+            return err
+         }
+         periodEntries, err := sampleEntries(periodInit)
+         if err != nil {
+            return err
+         }
+         // the output has one init segment, so every period must decode
+         // with it
+         if !slices.Equal(entries, periodEntries) {
+            return fmt.Errorf("period %d of %v changes codec configuration; periods without the stream, such as ads, are included unless SkipAds is set", index+1, streamId)
+         }
+         sources[index+1].init = periodInit
+      }
+   } else if len(periods) == 1 {
+      sources = nil
+   }
+   protection, err := getDashProtection(rep, optionsData.Drm)
    if err != nil {
       return err
    }
@@ -49,25 +82,87 @@ func downloadDash(mpd *dash.Mpd, threads, minBitrate int, streamId string, fetch
       allRequests:        allRequests,
       initSegmentData:    initData,
       manifestProtection: protection,
-      threads:            threads,
+      threads:            optionsData.Threads,
       fetchKey:           fetchKey,
-      minBitrate:         minBitrate,
+      minBitrate:         optionsData.MinBitrate,
+      drm:                optionsData.Drm,
+      result:             optionsData.Result,
+      licenseUrl:         optionsData.licenseUrl(),
+      subtitleFormat:     optionsData.SubtitleFormat,
+      periods:            sources,
+      start:              optionsData.Start,
+      end:                optionsData.End,
    }
    return orchestrateDownload(job)
 }
 
-// getDashInitSegment locates and fetches the initialization segment for a DASH representation.
-func getDashInitSegment(rep *dash.Representation, info *typeInfo) ([]byte, error) {
-   if !info.IsFmp4 {
+// getDashPeriods returns the representation of a stream in each period,
+// in presentation order. Periods without the stream, such as inserted ads,
+// use the representation with the same mime type and the closest bandwidth,
+// or are left out if skipAds is set.
+func getDashPeriods(mpd *dash.Mpd, group []*dash.Representation, skipAds bool) []*dash.Representation {
+   if len(mpd.Period) <= 1 {
+      return group
+   }
+   target := group[0]
+   var periods []*dash.Representation
+   for _, period := range mpd.Period {
+      index := slices.IndexFunc(group, func(rep *dash.Representation) bool {
+         return rep.Parent != nil && rep.Parent.Parent == period
+      })
+      if index >= 0 {
+         periods = append(periods, group[index])
+         continue
+      }
+      if skipAds {
+         log.Printf("skip period %v", period.Id)
+         continue
+      }
+      var closest *dash.Representation
+      for _, adaptation := range period.AdaptationSet {
+         for _, rep := range adaptation.Representation {
+            if rep.GetMimeType() != target.GetMimeType() {
+               continue
+            }
+            if closest == nil || bandwidthDistance(rep, target) < bandwidthDistance(closest, target) {
+               closest = rep
+            }
+         }
+      }
+      if closest == nil {
+         log.Printf("period %v has no %v stream", period.Id, target.GetMimeType())
+         continue
+      }
+      log.Printf("period %v uses representation %v", period.Id, closest.Id)
+      periods = append(periods, closest)
+   }
+   return periods
+}
+
+func bandwidthDistance(a, b *dash.Representation) int {
+   if a.Bandwidth > b.Bandwidth {
+      return a.Bandwidth - b.Bandwidth
+   }
+   return b.Bandwidth - a.Bandwidth
+}
+
+// getDashInitSegment locates and fetches the initialization segment for a
+// DASH representation, failing over across bases.
+func getDashInitSegment(rep *dash.Representation, info *typeInfo, bases []*dashBaseUrl) ([]byte, error) {
+   if !info.hasInit() {
+      return nil, nil
+   }
+   // Case 1: Initialization defined in SegmentBase. WebM files are fetched
+   // whole, header included, so their header must not be written again.
+   if rep.SegmentBase != nil && !info.IsFmp4 {
       return nil, nil
    }
-   // Case 1: Initialization defined in SegmentBase
    if rep.SegmentBase != nil && rep.SegmentBase.Initialization != nil {
       baseUrl, err := rep.ResolveBaseUrl()
       if err != nil {
          return nil, err
       }
-      return fetchData(baseUrl, map[string]string{"Range": "bytes=" + rep.SegmentBase.Initialization.Range}, true)
+      return fetchWithBases(baseUrl, map[string]string{"Range": "bytes=" + rep.SegmentBase.Initialization.Range}, bases)
    }
    // Case 2: Initialization defined in SegmentTemplate
    if template := rep.GetSegmentTemplate(); template != nil && template.Initialization != "" {
@@ -75,7 +170,7 @@ func getDashInitSegment(rep *dash.Representation, info *typeInfo) ([]byte, error
       if err != nil {
          return nil, fmt.Errorf("failed to resolve DASH SegmentTemplate initialization URL: %w", err)
       }
-      return fetchData(initUrl, nil, true)
+      return fetchWithBases(initUrl, nil, bases)
    }
    // Case 3: Initialization defined in SegmentList
    if sl := rep.SegmentList; sl != nil && sl.Initialization != nil {
@@ -89,7 +184,7 @@ func getDashInitSegment(rep *dash.Representation, info *typeInfo) ([]byte, error
          headers = map[string]string{"Range": "bytes=" + sl.Initialization.Range}
       }
 
-      return fetchData(initUrl, headers, true)
+      return fetchWithBases(initUrl, headers, bases)
    }
    return nil, nil
 }
@@ -114,18 +209,50 @@ func listStreamsDash(mpd *dash.Mpd) error {
    return nil
 }
 
-// detectDashType determines the file extension and container type from a DASH Representation's metadata.
+// detectDashType determines the file extension and container type from a
+// DASH Representation's mimeType and codecs.
 func detectDashType(rep *dash.Representation) (*typeInfo, error) {
-   switch rep.GetMimeType() {
-   case "video/mp4":
-      return &typeInfo{Extension: ".mp4", IsFmp4: true}, nil
-   case "audio/mp4":
-      return &typeInfo{Extension: ".m4a", IsFmp4: true}, nil
+   codecs := rep.GetCodecs()
+   kind := codecKind(codecs)
+   switch mimeType := rep.GetMimeType(); mimeType {
+   case "video/mp4", "audio/mp4", "application/mp4":
+      info := &typeInfo{Extension: ".mp4", IsFmp4: true, Codecs: codecs}
+      switch {
+      case kind == "audio":
+         info.Extension = ".m4a"
+      case kind == "" && mimeType == "audio/mp4":
+         info.Extension = ".m4a"
+      }
+      return info, nil
+   case "video/webm", "audio/webm":
+      return &typeInfo{Extension: ".webm", Codecs: codecs}, nil
    case "text/vtt":
       return &typeInfo{Extension: ".vtt", IsFmp4: false}, nil
+   case "text/ttml+xml", "application/ttml+xml":
+      return &typeInfo{Extension: ".ttml"}, nil
+   case "image/jpeg":
+      return &typeInfo{Extension: ".jpg", Images: true}, nil
+   case "image/png":
+      return &typeInfo{Extension: ".png", Images: true}, nil
    default:
-      return nil, fmt.Errorf("unsupported mime type for stream %s: %s", rep.Id, rep.GetMimeType())
+      return nil, fmt.Errorf("unsupported mime type for stream %s: %s", rep.Id, mimeType)
+   }
+}
+
+// codecKind returns "video", "audio" or "text" for an RFC 6381 codecs
+// string, from its first codec. Unknown codecs return "".
+func codecKind(codecs string) string {
+   codec, _, _ := strings.Cut(codecs, ",")
+   codec, _, _ = strings.Cut(strings.TrimSpace(codec), ".")
+   switch codec {
+   case "avc1", "avc3", "hvc1", "hev1", "dvh1", "dvhe", "av01", "vp08", "vp09", "vp8", "vp9":
+      return "video"
+   case "mp4a", "ac-3", "ec-3", "ac-4", "opus", "Opus", "fLaC", "flac", "vorbis", "dtsc", "dtse", "dtsx":
+      return "audio"
+   case "stpp", "wvtt", "tx3g":
+      return "text"
    }
+   return ""
 }
 
 // dash.go
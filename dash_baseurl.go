@@ -0,0 +1,211 @@
+package maya
+
+import (
+   "41.neocities.org/luna/dash"
+   "encoding/xml"
+   "log"
+   "math/rand/v2"
+   "net/url"
+   "slices"
+   "strings"
+)
+
+// dashBaseUrl is one BaseURL, usually one per CDN, resolved against the
+// BaseURLs of the levels above it.
+type dashBaseUrl struct {
+   Url             *url.URL
+   ServiceLocation string
+   // Priority and Weight are the DVB attributes: lower priorities are
+   // preferred, and weights share load within a priority.
+   Priority int
+   Weight   int
+}
+
+// dashBaseElement is one BaseURL element as written.
+type dashBaseElement struct {
+   Value           string `xml:",chardata"`
+   ServiceLocation string `xml:"serviceLocation,attr"`
+   Priority        *int   `xml:"priority,attr"`
+   Weight          *int   `xml:"weight,attr"`
+}
+
+// dashBases holds the BaseURL elements of every level of a manifest: MPD,
+// Period, AdaptationSet and Representation.
+type dashBases struct {
+   manifestUrl *url.URL
+   BaseUrl     []dashBaseElement `xml:"BaseURL"`
+   Period      []struct {
+      BaseUrl       []dashBaseElement `xml:"BaseURL"`
+      AdaptationSet []struct {
+         BaseUrl        []dashBaseElement `xml:"BaseURL"`
+         Representation []struct {
+            BaseUrl []dashBaseElement `xml:"BaseURL"`
+         } `xml:"Representation"`
+      } `xml:"AdaptationSet"`
+   } `xml:"Period"`
+}
+
+// parseDashBaseUrls reads the BaseURL elements of a manifest, or returns
+// nil if it cannot be parsed.
+func parseDashBaseUrls(body []byte, manifestUrl *url.URL) *dashBases {
+   bases := &dashBases{manifestUrl: manifestUrl}
+   if err := xml.Unmarshal(body, bases); err != nil {
+      return nil
+   }
+   return bases
+}
+
+// urls returns every base URL of rep, most preferred first: each BaseURL
+// of a level resolved against each of the level above. Representations
+// with fewer than two have nothing to fail over to, so nil is returned.
+func (d *dashBases) urls(mpd *dash.Mpd, rep *dash.Representation) []*dashBaseUrl {
+   if d == nil {
+      return nil
+   }
+   levels := [][]dashBaseElement{d.BaseUrl}
+   periodIndex := dashPeriodIndex(mpd, rep)
+   if periodIndex >= 0 && periodIndex < len(d.Period) {
+      period := d.Period[periodIndex]
+      levels = append(levels, period.BaseUrl)
+      adaptationIndex := slices.Index(mpd.Period[periodIndex].AdaptationSet, rep.Parent)
+      if adaptationIndex >= 0 && adaptationIndex < len(period.AdaptationSet) {
+         adaptation := period.AdaptationSet[adaptationIndex]
+         levels = append(levels, adaptation.BaseUrl)
+         repIndex := slices.Index(rep.Parent.Representation, rep)
+         if repIndex >= 0 && repIndex < len(adaptation.Representation) {
+            levels = append(levels, adaptation.Representation[repIndex].BaseUrl)
+         }
+      }
+   }
+   bases := []*dashBaseUrl{{Url: d.manifestUrl, Priority: 1, Weight: 1}}
+   for _, elements := range levels {
+      if len(elements) == 0 {
+         continue
+      }
+      var resolved []*dashBaseUrl
+      for _, parent := range bases {
+         for _, element := range elements {
+            location, err := parent.Url.Parse(strings.TrimSpace(element.Value))
+            if err != nil {
+               log.Printf("skip BaseURL %q: %v", element.Value, err)
+               continue
+            }
+            if slices.ContainsFunc(resolved, func(base *dashBaseUrl) bool {
+               return base.Url.String() == location.String()
+            }) {
+               continue
+            }
+            base := *parent
+            base.Url = location
+            if element.ServiceLocation != "" {
+               base.ServiceLocation = element.ServiceLocation
+            }
+            if element.Priority != nil {
+               base.Priority = *element.Priority
+            }
+            if element.Weight != nil {
+               base.Weight = *element.Weight
+            }
+            resolved = append(resolved, &base)
+         }
+      }
+      bases = resolved
+   }
+   if len(bases) < 2 {
+      return nil
+   }
+   slices.SortStableFunc(bases, func(a, b *dashBaseUrl) int {
+      return a.Priority - b.Priority
+   })
+   return bases
+}
+
+// applyBaseUrls gives each segment the same path on every other BaseURL to
+// fail over to. If spread is set, each segment starts on a CDN of the best
+// priority picked by weight, instead of the one it was resolved against.
+func applyBaseUrls(requests []segment, bases []*dashBaseUrl, spread bool) {
+   for index, req := range requests {
+      target := req.url.String()
+      var path string
+      var found bool
+      for _, base := range bases {
+         rest, ok := cutBaseUrl(target, base.Url.String())
+         if ok && (!found || len(rest) < len(path)) {
+            path, found = rest, true
+         }
+      }
+      if !found {
+         continue
+      }
+      order := bases
+      if spread {
+         order = spreadBaseUrls(bases)
+      }
+      var urls []*url.URL
+      if !spread {
+         urls = append(urls, req.url)
+      }
+      for _, base := range order {
+         alternate, err := url.Parse(base.Url.String() + path)
+         if err != nil || slices.ContainsFunc(urls, func(u *url.URL) bool {
+            return u.String() == alternate.String()
+         }) {
+            continue
+         }
+         urls = append(urls, alternate)
+      }
+      requests[index].url = urls[0]
+      requests[index].mirrors = urls[1:]
+   }
+}
+
+// cutBaseUrl returns target without the prefix base, if base ends at a
+// path boundary of target.
+func cutBaseUrl(target, base string) (string, bool) {
+   rest, ok := strings.CutPrefix(target, base)
+   if !ok {
+      return "", false
+   }
+   if rest == "" || strings.HasSuffix(base, "/") || rest[0] == '/' || rest[0] == '?' {
+      return rest, true
+   }
+   return "", false
+}
+
+// fetchWithBases fetches a request other than a media segment, such as an
+// init segment or sidx, failing over across bases like media segments.
+func fetchWithBases(target *url.URL, headers map[string]string, bases []*dashBaseUrl) ([]byte, error) {
+   requests := []segment{{url: target, headers: headers}}
+   applyBaseUrls(requests, bases, false)
+   return fetchRequest(requests[0], true)
+}
+
+// spreadBaseUrls returns bases with one CDN of the best priority, picked
+// at random by weight, moved to the front.
+func spreadBaseUrls(bases []*dashBaseUrl) []*dashBaseUrl {
+   best := bases[0].Priority
+   var total int
+   for _, base := range bases {
+      if base.Priority == best {
+         total += max(base.Weight, 0)
+      }
+   }
+   if total == 0 {
+      return bases
+   }
+   pick := rand.IntN(total)
+   for index, base := range bases {
+      if base.Priority != best {
+         break
+      }
+      pick -= max(base.Weight, 0)
+      if pick < 0 {
+         order := []*dashBaseUrl{base}
+         order = append(order, bases[:index]...)
+         return append(order, bases[index+1:]...)
+      }
+   }
+   return bases
+}
+
+// dash_baseurl.go
@@ -0,0 +1,108 @@
+package maya
+
+import (
+   "41.neocities.org/luna/dash"
+   "encoding/xml"
+   "fmt"
+   "slices"
+   "strconv"
+   "strings"
+   "time"
+)
+
+// parseDashPeriodStarts returns the start attribute of the periods of a
+// manifest, by period index. Periods without one are left out.
+func parseDashPeriodStarts(body []byte) map[int]time.Duration {
+   var mpd struct {
+      Period []struct {
+         Start string `xml:"start,attr"`
+      } `xml:"Period"`
+   }
+   if err := xml.Unmarshal(body, &mpd); err != nil {
+      return nil
+   }
+   starts := make(map[int]time.Duration)
+   for index, period := range mpd.Period {
+      if period.Start == "" {
+         continue
+      }
+      start, err := parseXsDuration(period.Start)
+      if err == nil {
+         starts[index] = start
+      }
+   }
+   return starts
+}
+
+// parseXsDuration parses an xs:duration such as PT1H2M3.5S. Years and
+// months have no fixed length and are rejected.
+func parseXsDuration(value string) (time.Duration, error) {
+   rest, ok := strings.CutPrefix(strings.TrimSpace(value), "P")
+   if !ok {
+      return 0, fmt.Errorf("invalid duration %q", value)
+   }
+   var total float64
+   inTime := false
+   for rest != "" {
+      if rest[0] == 'T' {
+         inTime = true
+         rest = rest[1:]
+         continue
+      }
+      end := strings.IndexAny(rest, "YMDHS")
+      if end <= 0 {
+         return 0, fmt.Errorf("invalid duration %q", value)
+      }
+      number, err := strconv.ParseFloat(rest[:end], 64)
+      if err != nil {
+         return 0, fmt.Errorf("invalid duration %q", value)
+      }
+      switch {
+      case rest[end] == 'D' && !inTime:
+         total += number * 86400
+      case rest[end] == 'H' && inTime:
+         total += number * 3600
+      case rest[end] == 'M' && inTime:
+         total += number * 60
+      case rest[end] == 'S' && inTime:
+         total += number
+      default:
+         return 0, fmt.Errorf("unsupported duration %q", value)
+      }
+      rest = rest[end+1:]
+   }
+   return secondsToDuration(total), nil
+}
+
+// dashPeriodIndex returns the index in the manifest of the period of rep,
+// or -1.
+func dashPeriodIndex(mpd *dash.Mpd, rep *dash.Representation) int {
+   if rep.Parent == nil {
+      return -1
+   }
+   return slices.Index(mpd.Period, rep.Parent.Parent)
+}
+
+// dashPeriodDuration returns the length of the period of rep in seconds:
+// the distance to the start of the next period, else its duration
+// attribute, else the sum of its segments.
+func dashPeriodDuration(mpd *dash.Mpd, declared map[int]time.Duration, rep *dash.Representation, segs []segment) float64 {
+   index := dashPeriodIndex(mpd, rep)
+   if index >= 0 {
+      start, ok := declared[index]
+      next, nextOk := declared[index+1]
+      if ok && nextOk && next > start {
+         return (next - start).Seconds()
+      }
+      if duration, err := mpd.Period[index].GetDuration(); err == nil && duration > 0 {
+         return duration.Seconds()
+      }
+   }
+   var total float64
+   for _, seg := range segs {
+      total += seg.duration
+   }
+   return total
+}
+
+// dash_period.go
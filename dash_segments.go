@@ -4,6 +4,9 @@ import (
    "41.neocities.org/luna/dash"
    "41.neocities.org/sofia"
    "errors"
+   "fmt"
+   "strings"
+   "time"
 )
 
 // generateSegmentsFromSidx parses a pre-fetched sidx box to generate segments.
@@ -30,7 +33,7 @@ func generateSegmentsFromSidx(rep *dash.Representation, sidxData []byte, groupSe
 
    currentOffset := end + 1
    chunkStart := currentOffset
-   var chunkDuration float64
+   var chunkDuration, chunkTime float64
 
    for index, ref := range sidx.References {
       refSize := uint64(ref.ReferencedSize)
@@ -45,9 +48,11 @@ func generateSegmentsFromSidx(rep *dash.Representation, sidxData []byte, groupSe
             headers:  map[string]string{"Range": "bytes=" + dash.FormatRange(chunkStart, endOffset)},
             duration: chunkDuration,
             sizeBits: (currentOffset - chunkStart) * 8,
+            time:     chunkTime,
          })
 
          chunkStart = currentOffset
+         chunkTime += chunkDuration
          chunkDuration = 0
       }
    }
@@ -61,41 +66,12 @@ func generateSegments(rep *dash.Representation) ([]segment, error) {
       return nil, err
    }
    if template := rep.GetSegmentTemplate(); template != nil {
-      urls, err := template.GetSegmentUrls(rep)
-      if err != nil {
-         return nil, err
-      }
-      segments := make([]segment, len(urls))
-      timescale := float64(template.GetTimescale())
-      if template.SegmentTimeline != nil {
-         currentIdx := 0
-         for _, entry := range template.SegmentTimeline.S {
-            count := 1
-            if entry.R > 0 {
-               count += entry.R
-            }
-            dur := float64(entry.D) / timescale
-            for repeatIdx := 0; repeatIdx < count; repeatIdx++ {
-               if currentIdx < len(segments) {
-                  segments[currentIdx].url = urls[currentIdx]
-                  segments[currentIdx].duration = dur
-               }
-               currentIdx++
-            }
-         }
-      } else {
-         dur := float64(template.Duration) / timescale
-         for segIdx := range segments {
-            segments[segIdx].url = urls[segIdx]
-            segments[segIdx].duration = dur
-         }
-      }
-      return segments, nil
+      return templateSegments(rep, template)
    }
    if sl := rep.SegmentList; sl != nil {
       segments := make([]segment, 0, len(sl.SegmentUrls))
       dur := float64(sl.Duration) / float64(sl.GetTimescale())
-      for _, seg := range sl.SegmentUrls {
+      for index, seg := range sl.SegmentUrls {
          mediaURL, err := seg.ResolveMedia()
          if err != nil {
             return nil, err
@@ -111,6 +87,7 @@ func generateSegments(rep *dash.Representation) ([]segment, error) {
             url:      mediaURL,
             headers:  headers, // Inject the headers here
             duration: dur,
+            time:     float64(index) * dur,
          })
       }
       return segments, nil
@@ -124,23 +101,62 @@ func generateSegments(rep *dash.Representation) ([]segment, error) {
    return []segment{{url: baseUrl, duration: duration}}, nil
 }
 
-// getDashMediaRequests generates the full list of media segments for a DASH representation group.
-func getDashMediaRequests(group []*dash.Representation, sidxData []byte) ([]segment, error) {
-   if len(group) == 0 {
-      return nil, nil
-   }
-   if group[0].SegmentBase != nil {
-      return generateSegmentsFromSidx(group[0], sidxData, true)
-   }
+// getDashMediaRequests generates the full list of media segments for the
+// representations of a stream, one per period. Each segment records the
+// index of its period, and its time from the start of the first period.
+// The periods are returned with their start and presentation offset.
+func getDashMediaRequests(mpd *dash.Mpd, periods []*dash.Representation, declared map[int]time.Duration, bases *dashBases) ([]segment, []sourcePeriod, error) {
    var requests []segment
-   for _, rep := range group {
-      segs, err := generateSegments(rep)
+   sources := make([]sourcePeriod, len(periods))
+   var previous []segment
+   for index, rep := range periods {
+      var segs []segment
+      var err error
+      // WebM indexes are Cues rather than sidx, so fetch the file whole
+      if rep.SegmentBase != nil && !strings.HasSuffix(rep.GetMimeType(), "/webm") {
+         var sidxData []byte
+         sidxData, err = fetchDashSidx(rep, bases.urls(mpd, rep))
+         if err != nil {
+            return nil, nil, err
+         }
+         segs, err = generateSegmentsFromSidx(rep, sidxData, true)
+      } else {
+         segs, err = generateSegments(rep)
+      }
       if err != nil {
-         return nil, err
+         return nil, nil, err
+      }
+      if index > 0 {
+         sources[index].start = sources[index-1].start + dashPeriodDuration(mpd, declared, periods[index-1], previous)
+      } else if start, ok := declared[dashPeriodIndex(mpd, rep)]; ok {
+         sources[index].start = start.Seconds()
+      }
+      if template := rep.GetSegmentTemplate(); template != nil {
+         sources[index].anchored = true
+         sources[index].presentationOffset = float64(template.PresentationTimeOffset) / float64(template.GetTimescale())
+      }
+      for segIdx := range segs {
+         segs[segIdx].period = index
+         segs[segIdx].time += sources[index].start
       }
       requests = append(requests, segs...)
+      previous = segs
+   }
+   return requests, sources, nil
+}
+
+// fetchDashSidx fetches the sidx box of a SegmentBase representation,
+// failing over across bases.
+func fetchDashSidx(rep *dash.Representation, bases []*dashBaseUrl) ([]byte, error) {
+   baseUrl, err := rep.ResolveBaseUrl()
+   if err != nil {
+      return nil, err
+   }
+   sidxData, err := fetchWithBases(baseUrl, map[string]string{"Range": "bytes=" + rep.SegmentBase.IndexRange}, bases)
+   if err != nil {
+      return nil, fmt.Errorf("failed to pre-fetch sidx data: %w", err)
    }
-   return requests, nil
+   return sidxData, nil
 }
 
 // dash_segments.go
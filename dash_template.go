@@ -0,0 +1,176 @@
+package maya
+
+import (
+   "41.neocities.org/luna/dash"
+   "errors"
+   "fmt"
+   "log"
+   "math"
+   "regexp"
+   "strconv"
+   "strings"
+)
+
+// templateTime is the start and duration of one segment, in timescale units.
+type templateTime struct {
+   start    uint64
+   duration uint64
+}
+
+// templateSegments expands a SegmentTemplate into the segments of one
+// period. Segments ending before presentationTimeOffset are left out, as are
+// segments past the period end or endNumber. availabilityTimeOffset only
+// matters at the live edge, so every segment of the period is listed.
+func templateSegments(rep *dash.Representation, template *dash.SegmentTemplate) ([]segment, error) {
+   if template.Media == "" {
+      return nil, errors.New("SegmentTemplate has no media attribute")
+   }
+   baseUrl, err := rep.ResolveBaseUrl()
+   if err != nil {
+      return nil, err
+   }
+   timescale := uint64(template.GetTimescale())
+   if timescale == 0 {
+      return nil, errors.New("SegmentTemplate timescale is zero")
+   }
+   startNumber := 1
+   if template.StartNumber != nil {
+      startNumber = *template.StartNumber
+   }
+   offset := uint64(template.PresentationTimeOffset)
+   // periodEnd is in timescale units, with zero meaning unknown
+   var periodEnd uint64
+   if rep.Parent != nil && rep.Parent.Parent != nil {
+      periodDuration, err := rep.Parent.Parent.GetDuration()
+      if err == nil && periodDuration > 0 {
+         periodEnd = offset + uint64(math.Round(periodDuration.Seconds()*float64(timescale)))
+      }
+   }
+   if template.AvailabilityTimeOffset > 0 {
+      log.Printf("availabilityTimeOffset %v ignored for on-demand download", template.AvailabilityTimeOffset)
+   }
+
+   var times []templateTime
+   if template.SegmentTimeline != nil {
+      times, err = expandTimeline(template.SegmentTimeline.S, periodEnd)
+      if err != nil {
+         return nil, err
+      }
+   } else {
+      if template.Duration <= 0 {
+         return nil, errors.New("SegmentTemplate has neither SegmentTimeline nor duration")
+      }
+      duration := uint64(template.Duration)
+      var count uint64
+      switch {
+      case template.EndNumber != nil:
+         if *template.EndNumber < startNumber {
+            return nil, fmt.Errorf("endNumber %d is before startNumber %d", *template.EndNumber, startNumber)
+         }
+         count = uint64(*template.EndNumber - startNumber + 1)
+      case periodEnd > 0:
+         count = (periodEnd - offset + duration - 1) / duration
+      default:
+         return nil, errors.New("cannot derive segment count: SegmentTemplate has no endNumber and the period has no duration")
+      }
+      for index := range count {
+         times = append(times, templateTime{start: offset + index*duration, duration: duration})
+      }
+   }
+
+   var segments []segment
+   for index, item := range times {
+      number := startNumber + index
+      if template.EndNumber != nil && number > *template.EndNumber {
+         break
+      }
+      if item.start+item.duration <= offset {
+         continue
+      }
+      if periodEnd > 0 && item.start >= periodEnd {
+         break
+      }
+      media := expandTemplate(template.Media, rep, number, item.start)
+      mediaUrl, err := baseUrl.Parse(media)
+      if err != nil {
+         return nil, fmt.Errorf("invalid segment URL %q: %w", media, err)
+      }
+      segments = append(segments, segment{
+         url:      mediaUrl,
+         duration: float64(item.duration) / float64(timescale),
+         time:     (float64(item.start) - float64(offset)) / float64(timescale),
+      })
+   }
+   if len(segments) == 0 {
+      return nil, fmt.Errorf("SegmentTemplate of representation %v has no segments", rep.Id)
+   }
+   return segments, nil
+}
+
+// expandTimeline lists the segments of a SegmentTimeline. A negative repeat
+// count lasts until the start of the next S, or until periodEnd for the last
+// S.
+func expandTimeline(entries []dash.S, periodEnd uint64) ([]templateTime, error) {
+   var times []templateTime
+   var position uint64
+   for index, entry := range entries {
+      if entry.D <= 0 {
+         return nil, fmt.Errorf("SegmentTimeline S %d has no duration", index)
+      }
+      if index == 0 || entry.T > 0 {
+         position = uint64(entry.T)
+      }
+      duration := uint64(entry.D)
+      count := uint64(entry.R) + 1
+      if entry.R < 0 {
+         var end uint64
+         if index+1 < len(entries) && entries[index+1].T > 0 {
+            end = uint64(entries[index+1].T)
+         } else if index+1 == len(entries) && periodEnd > 0 {
+            end = periodEnd
+         } else {
+            return nil, fmt.Errorf("cannot derive segment count: S %d has r=-1 but no following S@t and no period duration", index)
+         }
+         if end <= position {
+            return nil, fmt.Errorf("SegmentTimeline S %d ends at %d before it starts at %d", index, end, position)
+         }
+         count = (end - position + duration - 1) / duration
+      }
+      for range count {
+         times = append(times, templateTime{start: position, duration: duration})
+         position += duration
+      }
+   }
+   return times, nil
+}
+
+var templateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth|SubNumber)?(%0(\d+)d)?\$`)
+
+// expandTemplate substitutes the identifiers of a SegmentTemplate media
+// attribute.
+func expandTemplate(media string, rep *dash.Representation, number int, time uint64) string {
+   return templateIdentifier.ReplaceAllStringFunc(media, func(match string) string {
+      parts := templateIdentifier.FindStringSubmatch(match)
+      var value string
+      switch parts[1] {
+      case "":
+         return "$"
+      case "RepresentationID":
+         return rep.Id
+      case "Number":
+         value = strconv.Itoa(number)
+      case "Time":
+         value = strconv.FormatUint(time, 10)
+      case "Bandwidth":
+         value = strconv.Itoa(rep.Bandwidth)
+      default:
+         return match
+      }
+      if width, err := strconv.Atoi(parts[3]); err == nil && len(value) < width {
+         value = strings.Repeat("0", width-len(value)) + value
+      }
+      return value
+   })
+}
+
+// dash_template.go
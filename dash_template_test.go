@@ -0,0 +1,80 @@
+package maya
+
+import (
+   "41.neocities.org/luna/dash"
+   "slices"
+   "testing"
+)
+
+func TestExpandTimeline(t *testing.T) {
+   tests := []struct {
+      name      string
+      entries   []dash.S
+      periodEnd uint64
+      want      []templateTime
+   }{
+      {
+         name:    "repeat",
+         entries: []dash.S{{T: 100, D: 10, R: 2}, {D: 5}},
+         want:    []templateTime{{100, 10}, {110, 10}, {120, 10}, {130, 5}},
+      },
+      {
+         name:    "gap",
+         entries: []dash.S{{T: 0, D: 10}, {T: 30, D: 10}},
+         want:    []templateTime{{0, 10}, {30, 10}},
+      },
+      {
+         name:    "open repeat before next S",
+         entries: []dash.S{{T: 0, D: 10, R: -1}, {T: 25, D: 5}},
+         want:    []templateTime{{0, 10}, {10, 10}, {20, 10}, {25, 5}},
+      },
+      {
+         name:      "open repeat to period end",
+         entries:   []dash.S{{T: 0, D: 4, R: -1}},
+         periodEnd: 10,
+         want:      []templateTime{{0, 4}, {4, 4}, {8, 4}},
+      },
+   }
+   for _, test := range tests {
+      times, err := expandTimeline(test.entries, test.periodEnd)
+      if err != nil {
+         t.Fatalf("%s: %v", test.name, err)
+      }
+      if !slices.Equal(times, test.want) {
+         t.Errorf("%s: %v, want %v", test.name, times, test.want)
+      }
+   }
+}
+
+func TestExpandTimelineErrors(t *testing.T) {
+   tests := map[string][]dash.S{
+      "no duration":       {{T: 0}},
+      "open without end":  {{T: 0, D: 10, R: -1}},
+      "ends before start": {{T: 20, D: 10, R: -1}, {T: 10, D: 10}},
+   }
+   for name, entries := range tests {
+      if _, err := expandTimeline(entries, 0); err == nil {
+         t.Errorf("%s: no error", name)
+      }
+   }
+}
+
+func TestExpandTemplate(t *testing.T) {
+   rep := &dash.Representation{Id: "video", Bandwidth: 500000}
+   tests := []struct {
+      media string
+      want  string
+   }{
+      {"$RepresentationID$/$Number$.m4s", "video/7.m4s"},
+      {"$Number%05d$.m4s", "00007.m4s"},
+      {"t$Time$-$Bandwidth$.m4s", "t90000-500000.m4s"},
+      {"$$$Number$", "$7"},
+   }
+   for _, test := range tests {
+      if got := expandTemplate(test.media, rep, 7, 90000); got != test.want {
+         t.Errorf("%s = %s, want %s", test.media, got, test.want)
+      }
+   }
+}
+
+// dash_template_test.go
@@ -0,0 +1,178 @@
+package maya
+
+import (
+   "41.neocities.org/sofia"
+   "crypto/cipher"
+   "errors"
+   "fmt"
+)
+
+// protectionScheme holds the 'schm' scheme type and the 'tenc' defaults
+// of an encrypted track.
+type protectionScheme struct {
+   Type           string
+   CryptByteBlock uint8
+   SkipByteBlock  uint8
+   ConstantIv     []byte
+}
+
+// decrypt decrypts one sample in place according to the scheme. Pattern
+// and constant IV values from a 'seig' sample group override the defaults.
+func (s *protectionScheme) decrypt(data []byte, sample *sofia.SencSample, run cipherRun) {
+   if s == nil || s.Type == "cenc" {
+      sofia.Decrypt(data, sample, run.block)
+      return
+   }
+   crypt, skip, iv := int(s.CryptByteBlock), int(s.SkipByteBlock), s.ConstantIv
+   if run.entry != nil {
+      crypt, skip = int(run.entry.CryptByteBlock), int(run.entry.SkipByteBlock)
+      if len(run.entry.ConstantIv) > 0 {
+         iv = run.entry.ConstantIv
+      }
+   }
+   if sample != nil && len(sample.InitializationVector) > 0 {
+      iv = sample.InitializationVector
+   }
+   var fullIv [16]byte
+   copy(fullIv[:], iv)
+
+   ranges := protectedRanges(data, sample)
+   switch s.Type {
+   case "cens":
+      stream := cipher.NewCTR(run.block, fullIv[:])
+      for _, protected := range ranges {
+         forEachPattern(protected, crypt, skip, func(blocks []byte) {
+            stream.XORKeyStream(blocks, blocks)
+         })
+      }
+   case "cbc1":
+      mode := cipher.NewCBCDecrypter(run.block, fullIv[:])
+      for _, protected := range ranges {
+         forEachPattern(protected, 0, 0, func(blocks []byte) {
+            mode.CryptBlocks(blocks, blocks)
+         })
+      }
+   case "cbcs":
+      for _, protected := range ranges {
+         mode := cipher.NewCBCDecrypter(run.block, fullIv[:])
+         forEachPattern(protected, crypt, skip, func(blocks []byte) {
+            mode.CryptBlocks(blocks, blocks)
+         })
+      }
+   }
+}
+
+// protectedRanges splits a sample into its encrypted byte ranges using the
+// subsample map. Samples without subsamples are protected in full.
+func protectedRanges(data []byte, sample *sofia.SencSample) [][]byte {
+   if sample == nil || len(sample.Subsamples) == 0 {
+      return [][]byte{data}
+   }
+   var ranges [][]byte
+   offset := 0
+   for _, sub := range sample.Subsamples {
+      offset += int(sub.BytesOfClearData)
+      end := offset + int(sub.BytesOfProtectedData)
+      if end > len(data) {
+         end = len(data)
+      }
+      if offset < end {
+         ranges = append(ranges, data[offset:end])
+      }
+      offset = end
+   }
+   return ranges
+}
+
+// forEachPattern calls fn for every run of encrypted 16-byte blocks in a
+// protected range. A 0:0 pattern encrypts every whole block. Trailing
+// partial blocks are always left in the clear.
+func forEachPattern(protected []byte, crypt, skip int, fn func([]byte)) {
+   whole := len(protected) &^ (16 - 1)
+   if crypt == 0 && skip == 0 {
+      if whole > 0 {
+         fn(protected[:whole])
+      }
+      return
+   }
+   for offset := 0; offset < whole; offset += (crypt + skip) * 16 {
+      end := min(offset+crypt*16, whole)
+      fn(protected[offset:end])
+   }
+}
+
+// parseProtectionScheme reads the scheme type from 'sinf/schm' and the
+// pattern and constant IV from 'sinf/schi/tenc' of the first encrypted
+// sample entry in an init segment.
+func parseProtectionScheme(initData []byte) (*protectionScheme, error) {
+   for _, stsd := range findBoxes(initData, "moov", "trak", "mdia", "minf", "stbl", "stsd") {
+      if len(stsd.Payload) < 8 {
+         return nil, errors.New("truncated stsd box")
+      }
+      entries, err := readBoxes(stsd.Payload[8:])
+      if err != nil {
+         return nil, err
+      }
+      for _, entry := range entries {
+         var children []byte
+         switch entry.Type {
+         case "encv":
+            if len(entry.Payload) >= 78 {
+               children = entry.Payload[78:]
+            }
+         case "enca":
+            if len(entry.Payload) >= 28 {
+               children = entry.Payload[28:]
+            }
+         }
+         sinf := findBoxes(children, "sinf")
+         if len(sinf) == 0 {
+            continue
+         }
+         scheme := &protectionScheme{Type: "cenc"}
+         if schm := findBoxes(sinf[0].Payload, "schm"); len(schm) > 0 {
+            if len(schm[0].Payload) < 8 {
+               return nil, errors.New("truncated schm box")
+            }
+            scheme.Type = string(schm[0].Payload[4:8])
+         }
+         if tenc := findBoxes(sinf[0].Payload, "schi", "tenc"); len(tenc) > 0 {
+            if err := scheme.parseTenc(tenc[0].Payload); err != nil {
+               return nil, err
+            }
+         }
+         return scheme, nil
+      }
+   }
+   return nil, nil
+}
+
+// parseTenc reads the default pattern and constant IV of a 'tenc' payload.
+func (s *protectionScheme) parseTenc(payload []byte) error {
+   if len(payload) < 24 {
+      return errors.New("truncated tenc box")
+   }
+   if payload[0] > 0 {
+      s.CryptByteBlock = payload[5] >> 4
+      s.SkipByteBlock = payload[5] & 0xf
+   }
+   isProtected, ivSize := payload[6], payload[7]
+   if isProtected == 1 && ivSize == 0 {
+      if len(payload) < 25 || len(payload) < 25+int(payload[24]) {
+         return errors.New("truncated tenc constant IV")
+      }
+      s.ConstantIv = payload[25 : 25+int(payload[24])]
+   }
+   return nil
+}
+
+// validate rejects scheme types that cannot be decrypted.
+func (s *protectionScheme) validate() error {
+   switch s.Type {
+   case "cenc", "cens", "cbc1", "cbcs":
+      return nil
+   }
+   return fmt.Errorf("unsupported protection scheme: %q", s.Type)
+}
+
+// decrypt.go
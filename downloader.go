@@ -2,12 +2,13 @@ package maya
 
 import (
    "41.neocities.org/sofia"
-   "crypto/aes"
    "errors"
    "fmt"
    "io"
    "log"
+   "net/url"
    "os"
+   "path/filepath"
    "sync"
    "time"
 )
@@ -28,8 +29,9 @@ func checkBitrate(totalBytes uint64, totalDuration float64, minBitrate int) erro
 
 // executeDownload runs the concurrent worker pool to download all segments.
 // Segments present in the cached map are written from memory without
-// re-downloading.
-func executeDownload(requests []segment, key []byte, remux *sofia.Remuxer, file *os.File, threads int, cached map[int][]byte) error {
+// re-downloading. If transform is set, it is applied to every segment in
+// order before decryption and remuxing.
+func executeDownload(requests []segment, keys *keyRing, remux *sofia.Remuxer, file segmentWriter, threads int, cached map[int][]byte, transform segmentTransform) error {
    if threads > 12 {
       return errors.New("threads cannot be more than 12")
    }
@@ -55,13 +57,13 @@ func executeDownload(requests []segment, key []byte, remux *sofia.Remuxer, file
       go func() {
          defer wg.Done()
          for item := range workQueue {
-            data, err := fetchData(item.request.url, item.request.headers, false)
+            data, err := fetchSegment(item.request)
             results <- result{index: item.index, data: data, err: err}
          }
       }()
    }
    doneChan := make(chan error, 1)
-   go processAndWriteSegments(doneChan, results, len(requests), key, remux, file)
+   go processAndWriteSegments(doneChan, results, len(requests), keys, remux, file, transform)
 
    // Queue non-cached segments for download by workers.
    // Cached segments are sent directly as results — no re-download needed.
@@ -77,24 +79,77 @@ func executeDownload(requests []segment, key []byte, remux *sofia.Remuxer, file
    return <-doneChan
 }
 
+// fetchSegment downloads a segment, falling back to its mirrors in order.
+func fetchSegment(req segment) ([]byte, error) {
+   return fetchRequest(req, false)
+}
+
+// fetchRequest fetches req, trying its mirrors in order if it fails, and
+// then those of its failover.
+func fetchRequest(req segment, logReq bool) ([]byte, error) {
+   data, err := fetchData(req.url, req.headers, logReq)
+   try := func(mirrors []*url.URL) {
+      for _, mirror := range mirrors {
+         if err == nil {
+            return
+         }
+         log.Printf("%v: %v, trying %v", req.url.Host, err, mirror.Host)
+         data, err = fetchData(mirror, req.headers, logReq)
+      }
+   }
+   try(req.mirrors)
+   if err != nil && req.failover != nil {
+      try(req.failover())
+   }
+   return data, err
+}
+
+// segmentWriter receives the segments of a download in order, each whole
+// and with its index.
+type segmentWriter interface {
+   WriteSegment(index int, data []byte) error
+}
+
+// streamWriter writes segments back to back, as one file.
+type streamWriter struct {
+   io.Writer
+}
+
+func (s streamWriter) WriteSegment(_ int, data []byte) error {
+   _, err := s.Write(data)
+   return err
+}
+
+// imageWriter writes each segment of an image stream to its own file,
+// numbered from one by segment index.
+type imageWriter struct {
+   dir       string
+   extension string
+}
+
+func (w *imageWriter) WriteSegment(index int, data []byte) error {
+   name := filepath.Join(w.dir, fmt.Sprintf("%04d%s", index+1, w.extension))
+   return os.WriteFile(name, data, os.ModePerm)
+}
+
 // processAndWriteSegments consumes results from the worker pool, decrypts,
-// remuxes, and writes data in segment order.
+// remuxes, and writes data in segment order. The cipher of each sample is
+// resolved per segment so rotated keys are picked up as they appear.
 func processAndWriteSegments(
    doneChan chan<- error,
    results <-chan result,
    totalSegments int,
-   key []byte,
+   keys *keyRing,
    remux *sofia.Remuxer,
-   dst io.Writer,
+   dst segmentWriter,
+   transform segmentTransform,
 ) {
-   if remux != nil && len(key) > 0 {
-      block, err := aes.NewCipher(key)
-      if err != nil {
-         doneChan <- err
-         return
-      }
+   var ciphers *fragmentCiphers
+   if remux != nil && keys != nil {
       remux.OnSample = func(data []byte, sample *sofia.SencSample) {
-         sofia.Decrypt(data, sample, block)
+         if run := ciphers.next(); run.block != nil {
+            keys.scheme.decrypt(data, sample, run)
+         }
       }
    }
 
@@ -119,13 +174,30 @@ func processAndWriteSegments(
             break
          }
 
+         if transform != nil {
+            var err error
+            item.data, err = transform(nextIndex, item.data)
+            if err != nil {
+               doneChan <- err
+               return
+            }
+         }
+
          if remux != nil {
+            if keys != nil {
+               var err error
+               ciphers, err = keys.fragmentCiphers(item.data)
+               if err != nil {
+                  doneChan <- err
+                  return
+               }
+            }
             if err := remux.AddSegment(item.data); err != nil {
                doneChan <- err
                return
             }
          } else {
-            if _, err := dst.Write(item.data); err != nil {
+            if err := dst.WriteSegment(nextIndex, item.data); err != nil {
                doneChan <- err
                return
             }
@@ -183,7 +255,7 @@ func sampleBitrate(job *downloadJob) (map[int][]byte, error) {
       sampled[idx] = true
 
       seg := job.allRequests[idx]
-      data, err := fetchData(seg.url, seg.headers, false)
+      data, err := fetchSegment(seg)
       if err != nil {
          return nil, err
       }
@@ -256,6 +328,10 @@ func (t *tracker) update() {
    }
 }
 
+// segmentTransform rewrites the data of the segment at index. Calls are
+// made in segment order.
+type segmentTransform func(index int, data []byte) ([]byte, error)
+
 // workItem is a request bundled with its index for out-of-order processing.
 type workItem struct {
    index   int
@@ -6,19 +6,27 @@ import (
    "41.neocities.org/luna/dash"
    "41.neocities.org/sofia"
    "bytes"
+   "crypto/rsa"
+   "encoding/base64"
+   "encoding/binary"
+   "encoding/hex"
    "errors"
    "fmt"
    "log"
    "os"
-   "path/filepath"
+   "slices"
    "strings"
+   "sync"
 )
 
 const playReadySystemId = "9a04f07998404286ab92e65be0885f95"
 
 const widevineSystemId = "edef8ba979d64acea3c827dcd51d21ed"
 
-func getKeyForStream(fetcher keyFetcher, manifestProtection, initProtection *protectionInfo) ([]byte, error) {
+// getKeysForStream builds the key ring for a stream and fetches its default
+// key up front, so a license failure aborts before any media is written.
+func getKeysForStream(job *downloadJob, initProtection *protectionInfo) (*keyRing, error) {
+   manifestProtection := job.manifestProtection
    var keyId, contentId []byte
    if manifestProtection != nil && len(manifestProtection.ContentId) > 0 {
       contentId = manifestProtection.ContentId
@@ -33,144 +41,372 @@ func getKeyForStream(fetcher keyFetcher, manifestProtection, initProtection *pro
       log.Printf("key ID from MP4 tenc: %x", keyId)
    }
 
+   if manifestProtection != nil && manifestProtection.KeyId != nil {
+      if keyId == nil {
+         keyId = manifestProtection.KeyId
+         log.Printf("key ID from manifest: %x", keyId)
+      } else if !bytes.Equal(keyId, manifestProtection.KeyId) {
+         log.Printf("manifest key ID %x differs from MP4 tenc; using tenc", manifestProtection.KeyId)
+      }
+   }
+
    if keyId == nil {
-      log.Println("no key ID found in MP4 'tenc' box; assuming stream is not encrypted")
+      log.Println("no key ID found in MP4 'tenc' box or manifest; assuming stream is not encrypted")
       return nil, nil
    }
 
-   key, err := fetcher(keyId, contentId)
-   if err != nil {
-      return nil, fmt.Errorf("failed to fetch decryption key: %w", err)
+   keys := &keyRing{fetch: job.fetchKey, contentId: contentId, defaultId: keyId}
+   if initProtection != nil {
+      keys.groups = initProtection.SampleGroups
+      keys.scheme = initProtection.Scheme
+   }
+   if job.result != nil {
+      var pssh []byte
+      if manifestProtection != nil && manifestProtection.Pssh != nil {
+         pssh = manifestProtection.Pssh
+      } else if initProtection != nil {
+         pssh = initProtection.Pssh
+      }
+      keys.record = func(item ContentKey) {
+         job.result.Keys = append(job.result.Keys, KeyRecord{
+            StreamId:   job.outputFileNameBase,
+            KeyId:      item.KeyId,
+            Key:        item.Key,
+            Drm:        job.drm,
+            Pssh:       pssh,
+            LicenseUrl: job.licenseUrl,
+         })
+      }
+   }
+   if keys.scheme != nil {
+      if err := keys.scheme.validate(); err != nil {
+         return nil, err
+      }
+      log.Println("protection scheme:", keys.scheme.Type)
    }
+   if _, err := keys.block(keyId); err != nil {
+      return nil, err
+   }
+   return keys, nil
+}
 
-   return key, nil
+// PlayReadyBackend performs PlayReady license exchanges. Device is either a
+// .prd file or a directory holding bdevcert.dat, zprivsig.dat and
+// zprivencr.dat. Each exchange returns only the key of the requested KID;
+// other keys of a multi-key license are not read, so every KID takes its
+// own exchange.
+type PlayReadyBackend struct {
+   Device string
 }
 
-func playReadyKey(device string, keyId []byte, contentId string, fetchLicense func([]byte) ([]byte, error)) ([]byte, error) {
-   data, err := os.ReadFile(filepath.Join(device, "bdevcert.dat"))
+func (p *PlayReadyBackend) LicenseRequest(keyId, contentId []byte) ([]byte, DrmExchange, error) {
+   device, err := loadPlayReadyDevice(p.Device)
    if err != nil {
-      return nil, err
+      return nil, nil, err
    }
 
-   chain, err := playReady.ParseChain(data)
+   chain, err := playReady.ParseChain(device.Chain)
    if err != nil {
-      return nil, err
+      return nil, nil, fmt.Errorf("malformed PlayReady certificate chain: %w", err)
    }
 
-   data, err = os.ReadFile(filepath.Join(device, "zprivsig.dat"))
+   signingKey, err := playReady.ParseRawPrivateKey(device.SigningKey)
    if err != nil {
-      return nil, err
+      return nil, nil, fmt.Errorf("malformed PlayReady signing key: %w", err)
    }
 
-   signingKey, err := playReady.ParseRawPrivateKey(data)
+   encryptKey, err := playReady.ParseRawPrivateKey(device.EncryptKey)
    if err != nil {
-      return nil, err
+      return nil, nil, fmt.Errorf("malformed PlayReady encryption key: %w", err)
    }
 
-   data, err = os.ReadFile(filepath.Join(device, "zprivencr.dat"))
+   guid := bytes.Clone(keyId)
+   playReady.UuidOrGuid(guid)
+   data, err := chain.LicenseRequestBytes(signingKey, guid, string(contentId))
    if err != nil {
-      return nil, err
+      return nil, nil, err
    }
 
-   encryptKey, err := playReady.ParseRawPrivateKey(data)
-   if err != nil {
-      return nil, err
-   }
+   return data, &licenseExchange{parse: func(response []byte) ([]ContentKey, error) {
+      license, err := playReady.ParseLicense(response)
+      if err != nil {
+         return nil, err
+      }
 
-   playReady.UuidOrGuid(keyId)
-   data, err = chain.LicenseRequestBytes(signingKey, keyId, contentId)
-   if err != nil {
-      return nil, err
-   }
+      ok := bytes.Equal(
+         license.ContainerOuter.ContainerKeys.ContentKey.GuidKeyID, guid,
+      )
+      if !ok {
+         return nil, errors.New("key ID mismatch")
+      }
 
-   data, err = fetchLicense(data)
-   if err != nil {
-      return nil, err
-   }
+      key, err := license.Decrypt(encryptKey)
+      if err != nil {
+         return nil, err
+      }
+      // the KID is returned in the UUID order of the caller, not the GUID
+      // order of the license
+      return []ContentKey{{KeyId: keyId, Key: key}}, nil
+   }}, nil
+}
 
-   license, err := playReady.ParseLicense(data)
-   if err != nil {
-      return nil, err
-   }
+// WidevineBackend performs Widevine license exchanges. Device is either a
+// .wvd file or a directory holding device_client_id_blob and
+// device_private_key.
+type WidevineBackend struct {
+   Device string
+   // PrivacyMode encrypts the client identification with the service
+   // certificate, which is requested from the license server unless
+   // ServiceCertificate is set.
+   PrivacyMode        bool
+   ServiceCertificate []byte
+   // RootKey is the Widevine root public key. Privacy mode requires it, to
+   // verify the service certificate.
+   RootKey *rsa.PublicKey
+   // mutex guards service, which is shared by concurrent exchanges.
+   mutex   sync.Mutex
+   service *serviceCertificate
+}
 
-   ok := bytes.Equal(
-      license.ContainerOuter.ContainerKeys.ContentKey.GuidKeyID, keyId,
-   )
-   if !ok {
-      return nil, errors.New("key ID mismatch")
+func (w *WidevineBackend) CertificateRequest() []byte {
+   w.mutex.Lock()
+   defer w.mutex.Unlock()
+   if !w.PrivacyMode || w.service != nil || w.ServiceCertificate != nil {
+      return nil
    }
+   return widevineCertificateRequest
+}
 
-   key, err := license.Decrypt(encryptKey)
+func (w *WidevineBackend) SetCertificate(response []byte) error {
+   service, err := parseServiceCertificate(response, w.RootKey)
    if err != nil {
-      return nil, err
+      return err
    }
-
-   log.Printf("key: %x", key)
-   return key, nil
+   w.mutex.Lock()
+   w.service = service
+   w.mutex.Unlock()
+   return nil
 }
 
-func widevineKey(device string, keyId, contentId []byte, fetchLicense func([]byte) ([]byte, error)) ([]byte, error) {
-   client_id, err := os.ReadFile(filepath.Join(device, "device_client_id_blob"))
-   if err != nil {
-      return nil, err
+// certificate returns the service certificate, verifying ServiceCertificate
+// on first use.
+func (w *WidevineBackend) certificate() (*serviceCertificate, error) {
+   w.mutex.Lock()
+   service := w.service
+   w.mutex.Unlock()
+   if service == nil && w.ServiceCertificate != nil {
+      if err := w.SetCertificate(w.ServiceCertificate); err != nil {
+         return nil, err
+      }
+      return w.certificate()
    }
+   if service == nil {
+      return nil, errors.New("privacy mode requires a service certificate")
+   }
+   return service, nil
+}
 
-   pem_data, err := os.ReadFile(filepath.Join(device, "device_private_key"))
+func (w *WidevineBackend) LicenseRequest(keyId, contentId []byte) ([]byte, DrmExchange, error) {
+   device, err := loadWidevineDevice(w.Device)
    if err != nil {
-      return nil, err
+      return nil, nil, err
    }
 
    var pssh widevine.PsshData
    pssh.ContentId = contentId
    pssh.KeyIds = [][]byte{keyId}
-   req_data, err := pssh.EncodeLicenseRequest(client_id)
+   req_data, err := pssh.EncodeLicenseRequest(device.ClientId)
    if err != nil {
-      return nil, err
+      return nil, nil, err
+   }
+
+   if w.PrivacyMode {
+      service, err := w.certificate()
+      if err != nil {
+         return nil, nil, err
+      }
+      req_data, err = service.encryptClientId(req_data, device.ClientId)
+      if err != nil {
+         return nil, nil, err
+      }
    }
 
-   private_key, err := widevine.DecodePrivateKey(pem_data)
+   private_key, err := widevine.DecodePrivateKey(device.PrivateKey)
    if err != nil {
-      return nil, err
+      return nil, nil, err
    }
 
    signed_data, err := widevine.EncodeSignedMessage(req_data, private_key)
    if err != nil {
-      return nil, err
+      return nil, nil, err
    }
 
-   resp_data, err := fetchLicense(signed_data)
+   return signed_data, &licenseExchange{parse: func(resp_data []byte) ([]ContentKey, error) {
+      keys, err := widevine.DecodeLicenseResponse(resp_data, req_data, private_key)
+      if err != nil {
+         return nil, err
+      }
+
+      foundKey, err := widevine.GetKey(keys, keyId)
+      if err != nil {
+         return nil, err
+      }
+
+      var zero [16]byte
+      if bytes.Equal(foundKey, zero[:]) {
+         return nil, errors.New("zero key received")
+      }
+
+      found := []ContentKey{{KeyId: keyId, Key: foundKey}}
+      for _, container := range keys {
+         if len(container.Id) != 16 || len(container.Key) != 16 {
+            continue
+         }
+         if bytes.Equal(container.Id, keyId) || bytes.Equal(container.Key, zero[:]) {
+            continue
+         }
+         found = append(found, ContentKey{KeyId: container.Id, Key: container.Key})
+      }
+      return found, nil
+   }}, nil
+}
+
+// licenseExchange is the DrmExchange of the built-in backends.
+type licenseExchange struct {
+   parse func([]byte) ([]ContentKey, error)
+   keys  []ContentKey
+}
+
+func (l *licenseExchange) ParseLicense(response []byte) error {
+   keys, err := l.parse(response)
    if err != nil {
-      return nil, err
+      return err
+   }
+   l.keys = keys
+   return nil
+}
+
+func (l *licenseExchange) Keys() ([]ContentKey, error) {
+   return l.keys, nil
+}
+
+// backendKeys runs one license exchange through a backend and returns every
+// content key the license carries, which must include keyId.
+func backendKeys(backend DrmBackend, keyId, contentId []byte, fetchLicense func([]byte) ([]byte, error)) ([]ContentKey, error) {
+   if certifier, ok := backend.(DrmCertifier); ok {
+      if request := certifier.CertificateRequest(); request != nil {
+         response, err := fetchLicense(request)
+         if err != nil {
+            return nil, fmt.Errorf("failed to fetch service certificate: %w", err)
+         }
+         if err := certifier.SetCertificate(response); err != nil {
+            return nil, err
+         }
+      }
    }
 
-   keys, err := widevine.DecodeLicenseResponse(resp_data, req_data, private_key)
+   challenge, exchange, err := backend.LicenseRequest(keyId, contentId)
    if err != nil {
       return nil, err
    }
 
-   foundKey, err := widevine.GetKey(keys, keyId)
+   response, err := fetchLicense(challenge)
    if err != nil {
       return nil, err
    }
 
-   var zero [16]byte
-   if bytes.Equal(foundKey, zero[:]) {
-      return nil, errors.New("zero key received")
+   if err := exchange.ParseLicense(response); err != nil {
+      return nil, err
    }
 
-   log.Printf("key: %x", foundKey)
-   return foundKey, nil
+   keys, err := exchange.Keys()
+   if err != nil {
+      return nil, err
+   }
+   if findContentKey(keys, keyId) == nil {
+      return nil, fmt.Errorf("license did not contain key ID %x", keyId)
+   }
+   for _, item := range keys {
+      log.Printf("key %x: %x", item.KeyId, item.Key)
+   }
+   return keys, nil
 }
 
-type keyFetcher func(keyId, contentId []byte) ([]byte, error)
+// keyFetcher obtains the key for keyId. It may return further keys from
+// the same license exchange, which callers keep for other tracks.
+type keyFetcher func(keyId, contentId []byte) ([]ContentKey, error)
+
+// findContentKey returns the key for keyId from keys, if present.
+func findContentKey(keys []ContentKey, keyId []byte) []byte {
+   for _, item := range keys {
+      if bytes.Equal(item.KeyId, keyId) {
+         return item.Key
+      }
+   }
+   return nil
+}
 
 type protectionInfo struct {
    ContentId []byte
    KeyId     []byte
+   // SampleGroups holds 'seig' entries from the init segment for key
+   // rotation, by track ID.
+   SampleGroups map[uint32][]seigEntry
+   Scheme       *protectionScheme
+   // Pssh is the complete pssh box the IDs were read from.
+   Pssh []byte
+}
+
+// getDashProtection extracts the PSSH data for the chosen DRM system from a
+// representation, falling back to cenc:default_KID for the key ID.
+func getDashProtection(rep *dash.Representation, drm DrmSystem) (*protectionInfo, error) {
+   var info *protectionInfo
+   var err error
+   if drm == DrmPlayReady {
+      info, err = getDashPlayReadyProtection(rep)
+   } else {
+      info, err = getDashWidevineProtection(rep)
+   }
+   if err != nil {
+      return nil, err
+   }
+   keyId, err := getDashDefaultKid(rep)
+   if err != nil {
+      return nil, err
+   }
+   if keyId == nil {
+      return info, nil
+   }
+   if info == nil {
+      info = &protectionInfo{}
+   }
+   if info.KeyId == nil {
+      info.KeyId = keyId
+   } else if !bytes.Equal(info.KeyId, keyId) {
+      log.Printf("manifest key ID mismatch: default_KID %x, PSSH %x", keyId, info.KeyId)
+   }
+   return info, nil
+}
+
+// getDashDefaultKid reads the cenc:default_KID attribute from the
+// ContentProtection elements of a representation.
+func getDashDefaultKid(rep *dash.Representation) ([]byte, error) {
+   for _, contentProtection := range rep.GetContentProtection() {
+      if contentProtection.DefaultKid == "" {
+         continue
+      }
+      value := strings.ReplaceAll(strings.TrimSpace(contentProtection.DefaultKid), "-", "")
+      keyId, err := hex.DecodeString(value)
+      if err != nil || len(keyId) != 16 {
+         return nil, fmt.Errorf("invalid cenc:default_KID in manifest: %q", contentProtection.DefaultKid)
+      }
+      return keyId, nil
+   }
+   return nil, nil
 }
 
-// getDashProtection extracts Widevine PSSH data from a representation.
-func getDashProtection(rep *dash.Representation) (*protectionInfo, error) {
+// getDashWidevineProtection extracts Widevine PSSH data from a representation.
+func getDashWidevineProtection(rep *dash.Representation) (*protectionInfo, error) {
    const widevineUrn = "urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"
    var pssh_data []byte
    for _, contentProtection := range rep.GetContentProtection() {
@@ -190,15 +426,21 @@ func getDashProtection(rep *dash.Representation) (*protectionInfo, error) {
    if pssh_data == nil {
       return nil, nil
    }
+   return parseWidevinePssh(pssh_data)
+}
 
-   // If the data is wrapped in a standard MP4 pssh box, extract the payload.
-   // Otherwise, assume it's already the raw Widevine protobuf data.
-   if len(pssh_data) >= 8 && string(pssh_data[4:8]) == "pssh" {
-      pssh_box, err := sofia.DecodePsshBox(pssh_data)
-      if err != nil {
-         return nil, fmt.Errorf("could not parse pssh box from dash manifest: %w", err)
-      }
-      pssh_data = pssh_box.Data
+// parseWidevinePssh reads the content ID and first KID of Widevine PSSH
+// data. If the data is wrapped in a standard MP4 pssh box, the payload is
+// extracted. Otherwise, it is assumed to be the raw Widevine protobuf data.
+func parseWidevinePssh(pssh_data []byte) (*protectionInfo, error) {
+   box := pssh_data
+   pssh_data, err := unwrapPsshBox(pssh_data)
+   if err != nil {
+      return nil, err
+   }
+   if bytes.Equal(box, pssh_data) {
+      systemId, _ := hex.DecodeString(widevineSystemId)
+      box = encodePsshBox(systemId, pssh_data)
    }
 
    wv_data, err := widevine.DecodePsshData(pssh_data)
@@ -206,35 +448,273 @@ func getDashProtection(rep *dash.Representation) (*protectionInfo, error) {
       return nil, fmt.Errorf("could not decode widevine pssh data: %w", err)
    }
 
-   return &protectionInfo{ContentId: wv_data.ContentId, KeyId: nil}, nil
+   info := &protectionInfo{ContentId: wv_data.ContentId, Pssh: box}
+   if len(wv_data.KeyIds) > 0 {
+      info.KeyId = wv_data.KeyIds[0]
+   }
+   return info, nil
+}
+
+// encodePsshBox wraps system specific data in a version 0 pssh box.
+func encodePsshBox(systemId, data []byte) []byte {
+   box := binary.BigEndian.AppendUint32(nil, uint32(32+len(data)))
+   box = append(box, "pssh"...)
+   box = append(box, 0, 0, 0, 0)
+   box = append(box, systemId...)
+   box = binary.BigEndian.AppendUint32(box, uint32(len(data)))
+   return append(box, data...)
+}
+
+// unwrapPsshBox returns the system specific payload of a pssh box, or data
+// unchanged if it is not a pssh box.
+func unwrapPsshBox(data []byte) ([]byte, error) {
+   if len(data) < 8 || string(data[4:8]) != "pssh" {
+      return data, nil
+   }
+   pssh_box, err := sofia.DecodePsshBox(data)
+   if err != nil {
+      return nil, fmt.Errorf("could not parse pssh box: %w", err)
+   }
+   return pssh_box.Data, nil
+}
+
+// getDashPlayReadyProtection extracts the KID and content ID from PlayReady
+// ContentProtection elements, carried either as mspr:pro or as a cenc:pssh box.
+func getDashPlayReadyProtection(rep *dash.Representation) (*protectionInfo, error) {
+   playReadyUrns := []string{
+      "urn:uuid:9a04f079-9840-4286-ab92-e65be0885f95",
+      "urn:uuid:79f0049a-4098-8642-ab92-e65be0885f95",
+   }
+   for _, contentProtection := range rep.GetContentProtection() {
+      if !slices.Contains(playReadyUrns, strings.ToLower(contentProtection.SchemeIdUri)) {
+         continue
+      }
+      if contentProtection.Pro != "" {
+         pro, err := base64.StdEncoding.DecodeString(strings.TrimSpace(contentProtection.Pro))
+         if err != nil {
+            return nil, fmt.Errorf("could not decode playready pro from manifest: %w", err)
+         }
+         return parsePlayReadyObject(pro)
+      }
+      pssh, err := contentProtection.GetPssh()
+      if err != nil {
+         return nil, fmt.Errorf("could not parse playready pssh from manifest: %w", err)
+      }
+      if pssh == nil {
+         continue
+      }
+      pro, err := unwrapPsshBox(pssh)
+      if err != nil {
+         return nil, err
+      }
+      return parsePlayReadyObject(pro)
+   }
+   return nil, nil
+}
+
+// parsePlayReadyObject reads the content ID and first KID of a PlayReady
+// Object. The KID is returned in UUID byte order.
+func parsePlayReadyObject(pro []byte) (*protectionInfo, error) {
+   wrm, err := playReady.ParsePro(pro)
+   if err != nil {
+      return nil, fmt.Errorf("failed to parse PlayReady PRO: %w", err)
+   }
+   systemId, _ := hex.DecodeString(playReadySystemId)
+   info := &protectionInfo{Pssh: encodePsshBox(systemId, pro)}
+   if wrm.Data.CustomAttributes != nil {
+      info.ContentId = []byte(wrm.Data.CustomAttributes.ContentId)
+   }
+   keyIds, err := wrmKeyIds(wrm)
+   if err != nil {
+      return nil, err
+   }
+   if len(keyIds) > 0 {
+      info.KeyId = keyIds[0]
+   }
+   return info, nil
+}
+
+// wrmKeyIds decodes every KID of a WRM header, covering the 4.0 DATA/KID
+// and the 4.1+ PROTECTINFO forms. KIDs are returned in UUID byte order.
+func wrmKeyIds(wrm *playReady.WrmHeader) ([][]byte, error) {
+   var values []string
+   if wrm.Data.Kid != "" {
+      values = append(values, wrm.Data.Kid)
+   }
+   if protectInfo := wrm.Data.ProtectInfo; protectInfo != nil {
+      if protectInfo.Kid != nil {
+         values = append(values, protectInfo.Kid.Value)
+      }
+      for _, kid := range protectInfo.Kids {
+         values = append(values, kid.Value)
+      }
+   }
+   var keyIds [][]byte
+   for _, value := range values {
+      keyId, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+      if err != nil || len(keyId) != 16 {
+         return nil, fmt.Errorf("invalid KID in WRM header: %q", value)
+      }
+      playReady.UuidOrGuid(keyId)
+      keyIds = append(keyIds, keyId)
+   }
+   return keyIds, nil
 }
 
 // getKeyFetcher determines the appropriate key retrieval logic based on the DRM options.
-func (optionsData *Options) getKeyFetcher() (keyFetcher, error) {
-   if optionsData == nil || optionsData.Drm == DrmNone {
+func (optionsData *Options) getKeyFetcher(streamId string) (keyFetcher, error) {
+   if optionsData == nil {
       return nil, nil
    }
+   if optionsData.Drm == DrmNone && optionsData.Backend == nil {
+      return nil, nil
+   }
+
+   if optionsData.Drm == DrmKeys {
+      return optionsData.staticKeyFetcher()
+   }
+
+   if optionsData.License == nil && optionsData.Transport == nil {
+      return nil, errors.New("a License function or Transport is required when DRM is specified")
+   }
+
+   backend := optionsData.Backend
+   // keys of a custom backend are cached apart from the built-in one
+   var backendName string
+   if backend != nil {
+      backendName = fmt.Sprintf("%T", backend)
+   } else {
+      if optionsData.Device == "" {
+         return nil, errors.New("a Device path is required when DRM is specified")
+      }
+      switch optionsData.Drm {
+      case DrmWidevine:
+         backend = &WidevineBackend{
+            Device:             optionsData.Device,
+            PrivacyMode:        optionsData.PrivacyMode,
+            ServiceCertificate: optionsData.ServiceCertificate,
+            RootKey:            optionsData.RootKey,
+         }
+      case DrmPlayReady:
+         backend = &PlayReadyBackend{Device: optionsData.Device}
+      default:
+         return nil, fmt.Errorf("unsupported DRM system: %v", optionsData.Drm)
+      }
+   }
+   fetcher := func(keyId, contentId []byte) ([]ContentKey, error) {
+      fetchLicense := optionsData.licenseFunc(streamId, keyId, contentId)
+      return backendKeys(backend, keyId, contentId, fetchLicense)
+   }
+
+   if optionsData.Cache != "" {
+      fetcher = cachedKeyFetcher(optionsData.Cache, optionsData.Drm, backendName, optionsData.KeyLifetime, fetcher)
+   }
+   return rememberKeys(&optionsData.obtained, fetcher), nil
+}
+
+// licenseFunc returns the function sending one challenge: the Transport
+// with the context of the exchange if set, otherwise the License function.
+func (optionsData *Options) licenseFunc(streamId string, keyId, contentId []byte) func([]byte) ([]byte, error) {
+   if optionsData.Transport == nil {
+      return optionsData.License
+   }
+   return func(challenge []byte) ([]byte, error) {
+      return optionsData.Transport.exchange(&LicenseContext{
+         Challenge: challenge,
+         KeyId:     keyId,
+         ContentId: contentId,
+         StreamId:  streamId,
+         Drm:       optionsData.Drm,
+      })
+   }
+}
+
+// licenseUrl returns the license server URL of the Transport, if any.
+func (optionsData *Options) licenseUrl() string {
+   if optionsData.Transport == nil {
+      return ""
+   }
+   return optionsData.Transport.Url
+}
 
-   if optionsData.License == nil {
-      return nil, errors.New("a License function is required when DRM is specified")
+// keyStore keeps the keys obtained from licenses in memory.
+type keyStore struct {
+   mutex sync.Mutex
+   keys  []ContentKey
+}
+
+// rememberKeys wraps fetch so every key obtained is kept in store, letting
+// other KIDs of the same license skip an exchange, in this download or a
+// later one sharing the store.
+func rememberKeys(store *keyStore, fetch keyFetcher) keyFetcher {
+   return func(keyId, contentId []byte) ([]ContentKey, error) {
+      store.mutex.Lock()
+      defer store.mutex.Unlock()
+      if key := findContentKey(store.keys, keyId); key != nil {
+         return []ContentKey{{KeyId: keyId, Key: key}}, nil
+      }
+      keys, err := fetch(keyId, contentId)
+      if err != nil {
+         return nil, err
+      }
+      store.keys = append(store.keys, keys...)
+      return keys, nil
    }
+}
 
-   if optionsData.Device == "" {
-      return nil, errors.New("a Device path is required when DRM is specified")
+// staticKeyFetcher resolves keys locally from Options.Keys and Options.KeyFile.
+func (optionsData *Options) staticKeyFetcher() (keyFetcher, error) {
+   keys := make(map[string][]byte)
+   for keyId, key := range optionsData.Keys {
+      if err := addStaticKey(keys, keyId, key); err != nil {
+         return nil, err
+      }
+   }
+   if optionsData.KeyFile != "" {
+      data, err := os.ReadFile(optionsData.KeyFile)
+      if err != nil {
+         return nil, err
+      }
+      for index, line := range strings.Split(string(data), "\n") {
+         line = strings.TrimSpace(line)
+         if line == "" || strings.HasPrefix(line, "#") {
+            continue
+         }
+         keyId, key, ok := strings.Cut(line, ":")
+         if !ok {
+            return nil, fmt.Errorf("%s:%d: expected KID:KEY", optionsData.KeyFile, index+1)
+         }
+         if err := addStaticKey(keys, keyId, key); err != nil {
+            return nil, fmt.Errorf("%s:%d: %w", optionsData.KeyFile, index+1, err)
+         }
+      }
+   }
+   if len(keys) == 0 {
+      return nil, errors.New("a Keys map or KeyFile is required when DrmKeys is specified")
    }
+   return func(keyId, _ []byte) ([]ContentKey, error) {
+      key, ok := keys[hex.EncodeToString(keyId)]
+      if !ok {
+         return nil, fmt.Errorf("no key for key ID %x", keyId)
+      }
+      log.Printf("key %x: %x", keyId, key)
+      return []ContentKey{{KeyId: keyId, Key: key}}, nil
+   }, nil
+}
 
-   switch optionsData.Drm {
-   case DrmWidevine:
-      return func(keyId, contentId []byte) ([]byte, error) {
-         return widevineKey(optionsData.Device, keyId, contentId, optionsData.License)
-      }, nil
-   case DrmPlayReady:
-      return func(keyId, contentId []byte) ([]byte, error) {
-         return playReadyKey(optionsData.Device, keyId, string(contentId), optionsData.License)
-      }, nil
-   default:
-      return nil, fmt.Errorf("unsupported DRM system: %v", optionsData.Drm)
+// addStaticKey decodes a hex KID and key pair into keys. Dashes in the
+// KID are ignored so UUID notation is accepted.
+func addStaticKey(keys map[string][]byte, keyId, key string) error {
+   kid, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(keyId), "-", ""))
+   if err != nil || len(kid) != 16 {
+      return fmt.Errorf("invalid key ID %q", keyId)
+   }
+   value, err := hex.DecodeString(strings.TrimSpace(key))
+   if err != nil || len(value) != 16 {
+      return fmt.Errorf("invalid key %q for key ID %x", key, kid)
    }
+   keys[hex.EncodeToString(kid)] = value
+   return nil
 }
 
 // drm.go
@@ -0,0 +1,80 @@
+package maya
+
+import (
+   "bytes"
+   "encoding/binary"
+   "encoding/hex"
+   "testing"
+   "unicode/utf16"
+)
+
+// playReadyObject encodes a WRM header as a PlayReady Object with one
+// record.
+func playReadyObject(header string) []byte {
+   var record []byte
+   for _, unit := range utf16.Encode([]rune(header)) {
+      record = binary.LittleEndian.AppendUint16(record, unit)
+   }
+   pro := binary.LittleEndian.AppendUint32(nil, uint32(10+len(record)))
+   pro = binary.LittleEndian.AppendUint16(pro, 1)
+   pro = binary.LittleEndian.AppendUint16(pro, 1)
+   pro = binary.LittleEndian.AppendUint16(pro, uint16(len(record)))
+   return append(pro, record...)
+}
+
+func TestParsePlayReadyObject(t *testing.T) {
+   // KID 10000000-1000-1000-1000-100000000000 in GUID byte order is
+   // AAAAEAAQABAQABAAAAAAAA==
+   const keyId = "10000000100010001000100000000000"
+   tests := []struct {
+      name   string
+      header string
+   }{
+      {"4.0", `<WRMHEADER version="4.0.0.0"><DATA><KID>AAAAEAAQABAQABAAAAAAAA==</KID><CUSTOMATTRIBUTES><CONTENT_ID>movie</CONTENT_ID></CUSTOMATTRIBUTES></DATA></WRMHEADER>`},
+      {"4.1", `<WRMHEADER version="4.1.0.0"><DATA><PROTECTINFO><KID VALUE="AAAAEAAQABAQABAAAAAAAA==" ALGID="AESCTR"/></PROTECTINFO><CUSTOMATTRIBUTES><CONTENT_ID>movie</CONTENT_ID></CUSTOMATTRIBUTES></DATA></WRMHEADER>`},
+      {"4.2 utf-16", `<?xml version="1.0" encoding="utf-16"?><WRMHEADER version="4.2.0.0"><DATA><PROTECTINFO><KIDS><KID VALUE="AAAAEAAQABAQABAAAAAAAA==" ALGID="AESCTR"/><KID VALUE="AAAAIAAgACAgACAAAAAAAA==" ALGID="AESCTR"/></KIDS></PROTECTINFO><CUSTOMATTRIBUTES><CONTENT_ID>movie</CONTENT_ID></CUSTOMATTRIBUTES></DATA></WRMHEADER>`},
+   }
+   for _, test := range tests {
+      t.Run(test.name, func(t *testing.T) {
+         pro := playReadyObject(test.header)
+         info, err := parsePlayReadyObject(pro)
+         if err != nil {
+            t.Fatal(err)
+         }
+         if got := hex.EncodeToString(info.KeyId); got != keyId {
+            t.Errorf("key ID = %v, want %v", got, keyId)
+         }
+         if string(info.ContentId) != "movie" {
+            t.Errorf("content ID = %q, want movie", info.ContentId)
+         }
+         if !bytes.HasSuffix(info.Pssh, pro) {
+            t.Error("pssh box does not carry the PlayReady Object")
+         }
+      })
+   }
+}
+
+func TestRememberKeys(t *testing.T) {
+   video, audio := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)
+   var exchanges int
+   fetch := func(keyId, _ []byte) ([]ContentKey, error) {
+      exchanges++
+      return []ContentKey{{KeyId: video, Key: []byte("video key")}, {KeyId: audio, Key: []byte("audio key")}}, nil
+   }
+   var options Options
+   // the video and audio downloads of a title each build a fetcher
+   for _, keyId := range [][]byte{video, audio, video} {
+      keys, err := rememberKeys(&options.obtained, fetch)(keyId, nil)
+      if err != nil {
+         t.Fatal(err)
+      }
+      if findContentKey(keys, keyId) == nil {
+         t.Errorf("key ID %x: no key in %v", keyId, keys)
+      }
+   }
+   if exchanges != 1 {
+      t.Errorf("%d license exchanges, want 1", exchanges)
+   }
+}
+
+// drm_test.go
@@ -4,57 +4,100 @@ import (
    "41.neocities.org/luna/hls"
    "errors"
    "fmt"
+   "log"
    "net/url"
    "path"
    "slices"
 )
 
 // downloadHls parses an HLS manifest, extracts all necessary data, and passes it to the central orchestrator.
-func downloadHls(playlist *hls.MasterPlaylist, threads, minBitrate int, streamId string, fetchKey keyFetcher) error {
+func downloadHls(playlist *hls.MasterPlaylist, manifestData *Manifest, streamId string, optionsData *Options, fetchKey keyFetcher) error {
    targetUri, err := getHlsStreamUrl(playlist, streamId)
    if err != nil {
       return err
    }
-   mediaPl, err := fetchMediaPlaylist(targetUri)
+   mediaPl, backups, err := fetchRedundantPlaylists(
+      getHlsRedundantUrls(string(manifestData.Body), manifestData.Url, targetUri),
+   )
    if err != nil {
       return err
    }
+   mediaKeys := mediaPl.keys
+   sessionKeys := parseHlsKeys(string(manifestData.Body))
 
-   info, err := determineHlsType(mediaPl)
-   if err != nil {
-      return err
+   var initData []byte
+   if mediaPl.Map != nil {
+      initData, err = fetchRequest(segment{url: mediaPl.Map, failover: backups.initSection}, true)
+      if err != nil {
+         return fmt.Errorf("failed to get HLS initialization segment: %w", err)
+      }
+   }
+   if len(mediaPl.Segments) == 0 {
+      return errors.New("empty media playlist")
    }
-
    allRequests := make([]segment, len(mediaPl.Segments))
+   var position float64
    for index, hlsSeg := range mediaPl.Segments {
       allRequests[index] = segment{
          url:      hlsSeg.Uri,
          duration: hlsSeg.Duration,
+         time:     position,
       }
+      position += hlsSeg.Duration
    }
+   alignHlsMirrors(allRequests, mediaPl, backups)
 
-   var initData []byte
-   if info.IsFmp4 && mediaPl.Map != nil {
-      initData, err = fetchData(mediaPl.Map, nil, true)
-      if err != nil {
-         return fmt.Errorf("failed to get HLS initialization segment: %w", err)
-      }
+   hint := getHlsStreamHint(string(manifestData.Body), manifestData.Url, targetUri)
+   info, firstSegment, err := determineHlsType(allRequests[0], initData, hint)
+   if err != nil {
+      return err
+   }
+   if !info.IsFmp4 {
+      initData = nil
+   }
+
+   remuxTs := optionsData.RemuxTs && !info.IsFmp4 && info.Extension == ".ts"
+   if remuxTs && slices.ContainsFunc(mediaKeys, func(key hlsKey) bool {
+      return key.Method != "" && key.Method != "NONE"
+   }) {
+      return errors.New("cannot remux encrypted MPEG-TS segments; download them without RemuxTs")
+   }
+   protection, err := getHlsProtection(mediaKeys, sessionKeys, optionsData.Drm)
+   if err != nil {
+      return err
    }
    job := &downloadJob{
       outputFileNameBase: streamId,
       info:               info,
       allRequests:        allRequests,
       initSegmentData:    initData,
-      manifestProtection: nil,
-      threads:            threads,
+      manifestProtection: protection,
+      threads:            optionsData.Threads,
       fetchKey:           fetchKey,
-      minBitrate:         minBitrate,
+      minBitrate:         optionsData.MinBitrate,
+      drm:                optionsData.Drm,
+      result:             optionsData.Result,
+      licenseUrl:         optionsData.licenseUrl(),
+      subtitleFormat:     optionsData.SubtitleFormat,
+      start:              optionsData.Start,
+      end:                optionsData.End,
+      remuxTs:            remuxTs,
+      firstSegment:       firstSegment,
    }
    return orchestrateDownload(job)
 }
 
-// fetchMediaPlaylist fetches and parses an HLS media playlist.
-func fetchMediaPlaylist(mediaUrl *url.URL) (*hls.MediaPlaylist, error) {
+// mediaPlaylist is an HLS media playlist with the tags the hls package
+// does not keep.
+type mediaPlaylist struct {
+   *hls.MediaPlaylist
+   keys []hlsKey
+   // sequence is the EXT-X-MEDIA-SEQUENCE of the first segment.
+   sequence int
+}
+
+// fetchMediaPlaylist fetches and parses an HLS media playlist and its key tags.
+func fetchMediaPlaylist(mediaUrl *url.URL) (*mediaPlaylist, error) {
    data, err := fetchData(mediaUrl, nil, true)
    if err != nil {
       return nil, err
@@ -64,7 +107,11 @@ func fetchMediaPlaylist(mediaUrl *url.URL) (*hls.MediaPlaylist, error) {
       return nil, err
    }
    mediaPl.ResolveUris(mediaUrl)
-   return mediaPl, nil
+   return &mediaPlaylist{
+      MediaPlaylist: mediaPl,
+      keys:          parseHlsKeys(string(data)),
+      sequence:      parseMediaSequence(string(data)),
+   }, nil
 }
 
 // getHlsStreamUrl finds the correct stream in an HLS playlist by its ID and returns its URI.
@@ -107,33 +154,35 @@ func listStreamsHls(playlist *hls.MasterPlaylist) error {
    return nil
 }
 
-// determineHlsType extracts the file extension directly from the segment URL.
-func determineHlsType(mediaPl *hls.MediaPlaylist) (*typeInfo, error) {
-   if len(mediaPl.Segments) == 0 {
-      return nil, errors.New("empty media playlist")
+// determineHlsType identifies the container of an HLS stream. The init
+// section is sniffed if there is one, else a known segment extension
+// decides. Only a segment with another extension is fetched and sniffed,
+// and then returned so it is not fetched twice. The extension and the
+// master playlist hint are used when the content is not recognised, for
+// example when segments are encrypted.
+func determineHlsType(first segment, initData []byte, hint hlsStreamHint) (*typeInfo, []byte, error) {
+   if initData != nil {
+      if info := sniffContainer(initData, hint); info != nil {
+         return info, nil, nil
+      }
    }
-
-   firstSegUrl := mediaPl.Segments[0].Uri
-   ext := path.Ext(firstSegUrl.Path)
-   if ext == "" {
-      return nil, fmt.Errorf("no file extension found in segment URL: %s", firstSegUrl.String())
+   if info := extensionType(first.url, initData != nil, hint); info != nil {
+      return info, nil, nil
    }
-
-   if ext == ".mp4a" {
-      ext = ".m4a"
+   data, err := fetchSegment(first)
+   if err != nil {
+      log.Printf("cannot sniff first segment: %v", err)
    }
-
-   isFmp4 := false
-   if mediaPl.Map != nil {
-      isFmp4 = true
-   } else if ext == ".mp4" || ext == ".m4s" || ext == ".m4a" {
-      isFmp4 = true
+   if info := sniffContainer(data, hint); info != nil {
+      return info, data, nil
    }
-
-   return &typeInfo{
-      Extension: ext,
-      IsFmp4:    isFmp4,
-   }, nil
+   if ext := path.Ext(first.url.Path); ext != "" {
+      return &typeInfo{Extension: ext}, data, nil
+   }
+   if info := hint.typeInfo(); info != nil {
+      return info, data, nil
+   }
+   return nil, nil, fmt.Errorf("cannot determine the type of segment %s", first.url)
 }
 
 // hls.go
@@ -0,0 +1,150 @@
+package maya
+
+import (
+   "encoding/base64"
+   "encoding/hex"
+   "fmt"
+   "slices"
+   "strings"
+)
+
+// getHlsProtection builds the protection info for the chosen DRM system from
+// the key tags of the media playlist, then the session keys of the master
+// playlist.
+func getHlsProtection(mediaKeys, sessionKeys []hlsKey, drm DrmSystem) (*protectionInfo, error) {
+   var keyId []byte
+   for _, key := range slices.Concat(mediaKeys, sessionKeys) {
+      if key.Method == "" || key.Method == "NONE" {
+         continue
+      }
+      if keyId == nil && key.KeyId != "" {
+         value, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(key.KeyId), "0x"))
+         if err != nil || len(value) != 16 {
+            return nil, fmt.Errorf("invalid KEYID in playlist: %q", key.KeyId)
+         }
+         keyId = value
+      }
+      if key.system() != drm {
+         continue
+      }
+      data, err := key.data()
+      if err != nil {
+         return nil, err
+      }
+      if data == nil {
+         continue
+      }
+      var info *protectionInfo
+      if drm == DrmPlayReady {
+         pro, err := unwrapPsshBox(data)
+         if err != nil {
+            return nil, err
+         }
+         info, err = parsePlayReadyObject(pro)
+         if err != nil {
+            return nil, err
+         }
+      } else {
+         info, err = parseWidevinePssh(data)
+         if err != nil {
+            return nil, err
+         }
+      }
+      if info.KeyId == nil {
+         info.KeyId = keyId
+      }
+      return info, nil
+   }
+   if keyId != nil {
+      return &protectionInfo{KeyId: keyId}, nil
+   }
+   return nil, nil
+}
+
+// hlsKey is an EXT-X-KEY or EXT-X-SESSION-KEY tag.
+type hlsKey struct {
+   Method    string
+   Uri       string
+   KeyFormat string
+   KeyId     string
+}
+
+// data decodes the base64 payload of a data URI, or returns nil for any
+// other kind of URI.
+func (h *hlsKey) data() ([]byte, error) {
+   if !strings.HasPrefix(h.Uri, "data:") {
+      return nil, nil
+   }
+   _, payload, ok := strings.Cut(h.Uri, "base64,")
+   if !ok {
+      return nil, fmt.Errorf("key URI is not base64 encoded: %.32s", h.Uri)
+   }
+   data, err := base64.StdEncoding.DecodeString(payload)
+   if err != nil {
+      return nil, fmt.Errorf("could not decode key URI data: %w", err)
+   }
+   return data, nil
+}
+
+// system maps the KEYFORMAT of a key tag to a DRM system.
+func (h *hlsKey) system() DrmSystem {
+   switch strings.ToLower(h.KeyFormat) {
+   case "urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed":
+      return DrmWidevine
+   case "com.microsoft.playready", "urn:uuid:9a04f079-9840-4286-ab92-e65be0885f95":
+      return DrmPlayReady
+   }
+   return DrmNone
+}
+
+// parseHlsKeys reads the EXT-X-KEY and EXT-X-SESSION-KEY tags of a playlist.
+func parseHlsKeys(playlist string) []hlsKey {
+   var keys []hlsKey
+   for _, line := range strings.Split(playlist, "\n") {
+      line = strings.TrimSpace(line)
+      list, ok := strings.CutPrefix(line, "#EXT-X-KEY:")
+      if !ok {
+         list, ok = strings.CutPrefix(line, "#EXT-X-SESSION-KEY:")
+      }
+      if !ok {
+         continue
+      }
+      attributes := parseHlsAttributes(list)
+      keys = append(keys, hlsKey{
+         Method:    attributes["METHOD"],
+         Uri:       attributes["URI"],
+         KeyFormat: attributes["KEYFORMAT"],
+         KeyId:     attributes["KEYID"],
+      })
+   }
+   return keys
+}
+
+// parseHlsAttributes splits an HLS attribute list into names and values,
+// removing the quotes around quoted-string values.
+func parseHlsAttributes(list string) map[string]string {
+   attributes := make(map[string]string)
+   for list != "" {
+      name, rest, ok := strings.Cut(list, "=")
+      if !ok {
+         break
+      }
+      var value string
+      if strings.HasPrefix(rest, `"`) {
+         end := strings.Index(rest[1:], `"`)
+         if end < 0 {
+            value, rest = rest[1:], ""
+         } else {
+            value, rest = rest[1:end+1], rest[end+2:]
+         }
+         rest = strings.TrimPrefix(rest, ",")
+      } else {
+         value, rest, _ = strings.Cut(rest, ",")
+      }
+      attributes[strings.TrimSpace(name)] = value
+      list = rest
+   }
+   return attributes
+}
+
+// hls_keys.go
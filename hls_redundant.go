@@ -0,0 +1,192 @@
+package maya
+
+import (
+   "bufio"
+   "errors"
+   "log"
+   "maps"
+   "net/url"
+   "strconv"
+   "strings"
+   "sync"
+)
+
+// hlsEntry is one EXT-X-STREAM-INF or EXT-X-MEDIA tag of a master playlist.
+type hlsEntry struct {
+   tag        string
+   attributes map[string]string
+   uri        *url.URL
+}
+
+// parseHlsEntries returns the variants and renditions of a master playlist
+// with their raw attributes.
+func parseHlsEntries(master string, base *url.URL) []hlsEntry {
+   var entries []hlsEntry
+   var pending *hlsEntry
+   scanner := bufio.NewScanner(strings.NewReader(master))
+   for scanner.Scan() {
+      line := strings.TrimSpace(scanner.Text())
+      switch {
+      case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+         pending = &hlsEntry{
+            tag:        "STREAM-INF",
+            attributes: parseHlsAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:")),
+         }
+      case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+         entry := hlsEntry{
+            tag:        "MEDIA",
+            attributes: parseHlsAttributes(strings.TrimPrefix(line, "#EXT-X-MEDIA:")),
+         }
+         if uri, ok := entry.attributes["URI"]; ok {
+            entry.uri, _ = base.Parse(uri)
+            entries = append(entries, entry)
+         }
+      case line == "" || strings.HasPrefix(line, "#"):
+      case pending != nil:
+         pending.uri, _ = base.Parse(line)
+         entries = append(entries, *pending)
+         pending = nil
+      }
+   }
+   return entries
+}
+
+// redundantWith reports whether two entries describe the same stream on
+// different hosts: the same path and attributes. Group IDs are ignored,
+// since backup variants refer to backup renditions.
+func (e *hlsEntry) redundantWith(other *hlsEntry) bool {
+   if e.tag != other.tag || e.uri == nil || other.uri == nil {
+      return false
+   }
+   if e.uri.Host == other.uri.Host || e.uri.Path != other.uri.Path {
+      return false
+   }
+   ignore := func(name string, _ string) bool {
+      switch name {
+      case "URI", "GROUP-ID", "AUDIO", "VIDEO", "SUBTITLES", "CLOSED-CAPTIONS", "PATHWAY-ID":
+         return true
+      }
+      return false
+   }
+   a, b := maps.Clone(e.attributes), maps.Clone(other.attributes)
+   maps.DeleteFunc(a, ignore)
+   maps.DeleteFunc(b, ignore)
+   return maps.Equal(a, b)
+}
+
+// getHlsRedundantUrls returns target followed by the URIs of redundant
+// variants or renditions of the same stream.
+func getHlsRedundantUrls(master string, base, target *url.URL) []*url.URL {
+   urls := []*url.URL{target}
+   entries := parseHlsEntries(master, base)
+   for index := range entries {
+      if entries[index].uri == nil || entries[index].uri.String() != target.String() {
+         continue
+      }
+      for other := range entries {
+         if entries[index].redundantWith(&entries[other]) {
+            urls = append(urls, entries[other].uri)
+         }
+      }
+      break
+   }
+   if len(urls) > 1 {
+      log.Printf("%d redundant streams", len(urls)-1)
+   }
+   return urls
+}
+
+// fetchRedundantPlaylists fetches the media playlist of the first URL that
+// works. The URLs after it are returned as backups, fetched only once a
+// request to the primary fails.
+func fetchRedundantPlaylists(urls []*url.URL) (*mediaPlaylist, *hlsBackups, error) {
+   var err error
+   for index, mediaUrl := range urls {
+      mediaPl, fetchErr := fetchMediaPlaylist(mediaUrl)
+      if fetchErr != nil {
+         log.Printf("%v: %v", mediaUrl.Host, fetchErr)
+         err = errors.Join(err, fetchErr)
+         continue
+      }
+      return mediaPl, &hlsBackups{urls: urls[index+1:]}, nil
+   }
+   return nil, nil, err
+}
+
+// hlsBackups are the media playlists of the redundant streams of a
+// variant or rendition. They are fetched on first use; any that fail are
+// left out.
+type hlsBackups struct {
+   urls      []*url.URL
+   once      sync.Once
+   playlists []*mediaPlaylist
+}
+
+func (h *hlsBackups) get() []*mediaPlaylist {
+   h.once.Do(func() {
+      for _, mediaUrl := range h.urls {
+         mediaPl, err := fetchMediaPlaylist(mediaUrl)
+         if err != nil {
+            log.Printf("%v: %v", mediaUrl.Host, err)
+            continue
+         }
+         h.playlists = append(h.playlists, mediaPl)
+      }
+   })
+   return h.playlists
+}
+
+// segment returns the segment with the given media sequence number in each
+// backup playlist.
+func (h *hlsBackups) segment(sequence int) []*url.URL {
+   var urls []*url.URL
+   for _, backup := range h.get() {
+      index := sequence - backup.sequence
+      if index >= 0 && index < len(backup.Segments) {
+         urls = append(urls, backup.Segments[index].Uri)
+      }
+   }
+   return urls
+}
+
+// initSection returns the EXT-X-MAP of each backup playlist.
+func (h *hlsBackups) initSection() []*url.URL {
+   var urls []*url.URL
+   for _, backup := range h.get() {
+      if backup.Map != nil {
+         urls = append(urls, backup.Map)
+      }
+   }
+   return urls
+}
+
+// alignHlsMirrors lets each segment fail over to the segment with the same
+// media sequence number in each backup playlist.
+func alignHlsMirrors(requests []segment, primary *mediaPlaylist, backups *hlsBackups) {
+   if len(backups.urls) == 0 {
+      return
+   }
+   for index := range requests {
+      sequence := primary.sequence + index
+      requests[index].failover = func() []*url.URL {
+         return backups.segment(sequence)
+      }
+   }
+}
+
+// parseMediaSequence returns the EXT-X-MEDIA-SEQUENCE of a media playlist,
+// which defaults to zero.
+func parseMediaSequence(playlist string) int {
+   for line := range strings.Lines(playlist) {
+      value, ok := strings.CutPrefix(strings.TrimSpace(line), "#EXT-X-MEDIA-SEQUENCE:")
+      if ok {
+         sequence, err := strconv.Atoi(value)
+         if err == nil {
+            return sequence
+         }
+      }
+   }
+   return 0
+}
+
+// hls_redundant.go
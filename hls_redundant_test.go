@@ -0,0 +1,46 @@
+package maya
+
+import (
+   "net/url"
+   "slices"
+   "testing"
+)
+
+func TestGetHlsRedundantUrls(t *testing.T) {
+   const master = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac-128",NAME="English",LANGUAGE="en",URI="https://a.example/audio/128.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac-64",NAME="English",LANGUAGE="en",URI="https://a.example/audio/64.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac-128-backup",NAME="English",LANGUAGE="en",URI="https://b.example/audio/128.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=3000000,RESOLUTION=1280x720,AUDIO="aac-128"
+https://a.example/video/720.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1500000,RESOLUTION=1280x720,AUDIO="aac-64"
+https://a.example/video/720-low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=3000000,RESOLUTION=1280x720,AUDIO="aac-128-backup"
+https://b.example/video/720.m3u8
+`
+   base, err := url.Parse("https://a.example/master.m3u8")
+   if err != nil {
+      t.Fatal(err)
+   }
+   tests := map[string][]string{
+      "https://a.example/audio/128.m3u8":     {"https://a.example/audio/128.m3u8", "https://b.example/audio/128.m3u8"},
+      "https://a.example/audio/64.m3u8":      {"https://a.example/audio/64.m3u8"},
+      "https://a.example/video/720.m3u8":     {"https://a.example/video/720.m3u8", "https://b.example/video/720.m3u8"},
+      "https://a.example/video/720-low.m3u8": {"https://a.example/video/720-low.m3u8"},
+   }
+   for target, want := range tests {
+      targetUrl, err := url.Parse(target)
+      if err != nil {
+         t.Fatal(err)
+      }
+      var got []string
+      for _, redundant := range getHlsRedundantUrls(master, base, targetUrl) {
+         got = append(got, redundant.String())
+      }
+      if !slices.Equal(got, want) {
+         t.Errorf("%s: %v, want %v", target, got, want)
+      }
+   }
+}
+
+// hls_redundant_test.go
@@ -0,0 +1,152 @@
+package maya
+
+import (
+   "bytes"
+   "net/url"
+   "path"
+   "slices"
+   "strings"
+)
+
+// hlsStreamHint is what the master playlist says about a stream.
+type hlsStreamHint struct {
+   // Codecs is the CODECS attribute of a variant.
+   Codecs string
+   // MediaType is the TYPE attribute of a rendition.
+   MediaType string
+}
+
+// getHlsStreamHint finds the master playlist entry for target.
+func getHlsStreamHint(master string, base, target *url.URL) hlsStreamHint {
+   for _, entry := range parseHlsEntries(master, base) {
+      if entry.uri != nil && entry.uri.String() == target.String() {
+         return hlsStreamHint{
+            Codecs: entry.attributes["CODECS"], MediaType: entry.attributes["TYPE"],
+         }
+      }
+   }
+   return hlsStreamHint{}
+}
+
+// audioOnly reports whether the CODECS of the hint are all audio codecs.
+func (h hlsStreamHint) audioOnly() bool {
+   if h.MediaType == "AUDIO" {
+      return true
+   }
+   if h.Codecs == "" {
+      return false
+   }
+   for codec := range strings.SplitSeq(h.Codecs, ",") {
+      codec = strings.TrimSpace(codec)
+      if !strings.HasPrefix(codec, "mp4a") && !strings.HasPrefix(codec, "ac-3") &&
+         !strings.HasPrefix(codec, "ec-3") && !strings.HasPrefix(codec, "opus") &&
+         !strings.HasPrefix(codec, "fLaC") {
+         return false
+      }
+   }
+   return true
+}
+
+// typeInfo guesses the type of a stream from the hint alone.
+func (h hlsStreamHint) typeInfo() *typeInfo {
+   switch {
+   case h.MediaType == "SUBTITLES":
+      return &typeInfo{Extension: ".vtt"}
+   case strings.Contains(h.Codecs, "wvtt") || strings.Contains(h.Codecs, "stpp"):
+      return &typeInfo{Extension: ".mp4", IsFmp4: true}
+   }
+   return nil
+}
+
+// extensionType returns the type given by the extension of a segment URL,
+// or nil if the extension does not settle it. Segments with an init section
+// are fMP4 whatever their extension.
+func extensionType(segmentUrl *url.URL, hasMap bool, hint hlsStreamHint) *typeInfo {
+   ext := path.Ext(segmentUrl.Path)
+   switch ext {
+   case ".ts", ".aac", ".ac3", ".ec3", ".vtt":
+      if !hasMap {
+         return &typeInfo{Extension: ext}
+      }
+   case ".webvtt":
+      if !hasMap {
+         return &typeInfo{Extension: ".vtt"}
+      }
+   case ".mp4", ".m4s", ".m4v", ".cmfv":
+   case ".m4a", ".mp4a", ".cmfa":
+      return &typeInfo{Extension: ".m4a", IsFmp4: true}
+   default:
+      if !hasMap {
+         return nil
+      }
+   }
+   if hint.audioOnly() {
+      return &typeInfo{Extension: ".m4a", IsFmp4: true}
+   }
+   return &typeInfo{Extension: ".mp4", IsFmp4: true}
+}
+
+// sniffContainer identifies the container of the start of a segment or init
+// section, or returns nil if it is not recognised.
+func sniffContainer(data []byte, hint hlsStreamHint) *typeInfo {
+   if len(data) >= 8 {
+      switch string(data[4:8]) {
+      case "ftyp", "styp", "moov", "moof", "sidx", "emsg", "free":
+         info := &typeInfo{Extension: ".mp4", IsFmp4: true}
+         if handlers := mp4Handlers(data); handlers != nil {
+            switch {
+            case !slices.ContainsFunc(handlers, func(handler string) bool {
+               return handler != "soun"
+            }):
+               info.Extension = ".m4a"
+            case !slices.Contains(handlers, "vide") && !slices.Contains(handlers, "soun"):
+               // timed text such as wvtt or stpp
+               info.Extension = ".mp4"
+            }
+         } else if hint.audioOnly() {
+            info.Extension = ".m4a"
+         }
+         return info
+      }
+   }
+   if len(data) >= 1 && data[0] == 0x47 && (len(data) <= 188 || data[188] == 0x47) {
+      return &typeInfo{Extension: ".ts"}
+   }
+   text := bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+   if bytes.HasPrefix(text, []byte("WEBVTT")) {
+      return &typeInfo{Extension: ".vtt"}
+   }
+   id3 := false
+   for len(data) >= 10 && string(data[:3]) == "ID3" {
+      size := 10 + (int(data[6]&0x7f)<<21 | int(data[7]&0x7f)<<14 | int(data[8]&0x7f)<<7 | int(data[9]&0x7f))
+      if data[5]&0x10 != 0 {
+         size += 10
+      }
+      id3 = true
+      data = data[min(size, len(data)):]
+   }
+   switch {
+   case len(data) >= 2 && data[0] == 0xff && data[1]&0xf6 == 0xf0:
+      return &typeInfo{Extension: ".aac"}
+   case len(data) >= 2 && data[0] == 0x0b && data[1] == 0x77:
+      return &typeInfo{Extension: ".ac3"}
+   case id3 && len(data) == 0 && hint.audioOnly():
+      // the ID3 tag filled the sniffed range
+      return &typeInfo{Extension: ".aac"}
+   }
+   return nil
+}
+
+// mp4Handlers returns the handler type of each track of an init segment, or
+// nil if data has no moov.
+func mp4Handlers(data []byte) []string {
+   var handlers []string
+   for _, hdlr := range findBoxes(data, "moov", "trak", "mdia", "hdlr") {
+      if len(hdlr.Payload) >= 12 {
+         handlers = append(handlers, string(hdlr.Payload[8:12]))
+      }
+   }
+   return handlers
+}
+
+// hls_sniff.go
@@ -0,0 +1,84 @@
+package maya
+
+import (
+   "net/url"
+   "testing"
+)
+
+// handlerInit builds an init segment with one track per handler type.
+func handlerInit(handlers ...string) []byte {
+   var traks [][]byte
+   for _, handler := range handlers {
+      hdlr := append(make([]byte, 8), handler...)
+      hdlr = append(hdlr, make([]byte, 13)...)
+      traks = append(traks, appendBox(nil, "trak", appendBox(nil, "mdia", appendBox(nil, "hdlr", hdlr))))
+   }
+   init := appendBox(nil, "ftyp", []byte("iso6"), make([]byte, 4))
+   return appendBox(init, "moov", traks...)
+}
+
+func TestSniffContainer(t *testing.T) {
+   ts := make([]byte, 189)
+   ts[0], ts[188] = 0x47, 0x47
+   id3 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x02"), 0, 0)
+   tests := []struct {
+      name string
+      data []byte
+      hint hlsStreamHint
+      want *typeInfo
+   }{
+      {"video init", handlerInit("vide", "soun"), hlsStreamHint{}, &typeInfo{Extension: ".mp4", IsFmp4: true}},
+      {"audio init", handlerInit("soun"), hlsStreamHint{}, &typeInfo{Extension: ".m4a", IsFmp4: true}},
+      {"text init", handlerInit("text"), hlsStreamHint{}, &typeInfo{Extension: ".mp4", IsFmp4: true}},
+      {"audio segment", appendBox(nil, "styp", []byte("msdh")), hlsStreamHint{Codecs: "mp4a.40.2"}, &typeInfo{Extension: ".m4a", IsFmp4: true}},
+      {"transport stream", ts, hlsStreamHint{}, &typeInfo{Extension: ".ts"}},
+      {"webvtt", []byte("\xef\xbb\xbfWEBVTT\n\n"), hlsStreamHint{}, &typeInfo{Extension: ".vtt"}},
+      {"adts after id3", append(id3, 0xff, 0xf1), hlsStreamHint{}, &typeInfo{Extension: ".aac"}},
+      {"ac-3", []byte{0x0b, 0x77, 0, 0}, hlsStreamHint{}, &typeInfo{Extension: ".ac3"}},
+      {"id3 only", id3, hlsStreamHint{MediaType: "AUDIO"}, &typeInfo{Extension: ".aac"}},
+      {"encrypted", []byte{0x12, 0x34, 0x56, 0x78, 0x9a}, hlsStreamHint{}, nil},
+   }
+   for _, test := range tests {
+      info := sniffContainer(test.data, test.hint)
+      switch {
+      case test.want == nil:
+         if info != nil {
+            t.Errorf("%s: %+v, want nil", test.name, info)
+         }
+      case info == nil || *info != *test.want:
+         t.Errorf("%s: %+v, want %+v", test.name, info, test.want)
+      }
+   }
+}
+
+func TestExtensionType(t *testing.T) {
+   tests := []struct {
+      path   string
+      hasMap bool
+      hint   hlsStreamHint
+      want   *typeInfo
+   }{
+      {"/seg1.ts", false, hlsStreamHint{}, &typeInfo{Extension: ".ts"}},
+      {"/seg1.webvtt", false, hlsStreamHint{}, &typeInfo{Extension: ".vtt"}},
+      {"/seg1.m4s", false, hlsStreamHint{}, &typeInfo{Extension: ".mp4", IsFmp4: true}},
+      {"/seg1.m4s", false, hlsStreamHint{MediaType: "AUDIO"}, &typeInfo{Extension: ".m4a", IsFmp4: true}},
+      {"/seg1.cmfa", false, hlsStreamHint{}, &typeInfo{Extension: ".m4a", IsFmp4: true}},
+      {"/seg1.ts", true, hlsStreamHint{}, &typeInfo{Extension: ".mp4", IsFmp4: true}},
+      {"/segment", true, hlsStreamHint{}, &typeInfo{Extension: ".mp4", IsFmp4: true}},
+      {"/segment", false, hlsStreamHint{}, nil},
+      {"/seg1.php", false, hlsStreamHint{}, nil},
+   }
+   for _, test := range tests {
+      info := extensionType(&url.URL{Path: test.path}, test.hasMap, test.hint)
+      switch {
+      case test.want == nil:
+         if info != nil {
+            t.Errorf("%s: %+v, want nil", test.path, info)
+         }
+      case info == nil || *info != *test.want:
+         t.Errorf("%s map %v: %+v, want %+v", test.path, test.hasMap, info, test.want)
+      }
+   }
+}
+
+// hls_sniff_test.go
@@ -0,0 +1,259 @@
+package maya
+
+import (
+   "41.neocities.org/luna/dash"
+   "41.neocities.org/luna/hls"
+   "bytes"
+   "encoding/base64"
+   "encoding/binary"
+   "encoding/hex"
+   "errors"
+   "fmt"
+   "io"
+   "slices"
+   "strings"
+)
+
+// StreamProtection reports the DRM signalling of one stream.
+type StreamProtection struct {
+   StreamId  string
+   Scheme    string
+   KeyIds    [][]byte
+   ContentId []byte
+   Pssh      []PsshInfo
+   // Err is why the stream could not be inspected in full.
+   Err error
+}
+
+// PsshInfo is one PSSH box or DRM header found for a stream.
+type PsshInfo struct {
+   System string
+   // Source is where the data was found: manifest, playlist or init.
+   Source string
+   Data   []byte
+}
+
+// InspectDash reports the protection of every stream in a DASH manifest.
+// Only init segments are fetched, never media segments.
+func InspectDash(manifestData *Manifest) ([]*StreamProtection, error) {
+   mpd, err := dash.Parse(manifestData.Body, manifestData.Url)
+   if err != nil {
+      return nil, err
+   }
+   bases := parseDashBaseUrls(manifestData.Body, manifestData.Url)
+   var streams []*StreamProtection
+   for streamId, group := range mpd.GetRepresentations() {
+      if len(group) == 0 {
+         continue
+      }
+      rep := group[0]
+      stream := &StreamProtection{StreamId: streamId}
+      for _, drm := range []DrmSystem{DrmWidevine, DrmPlayReady} {
+         protection, err := getDashProtection(rep, drm)
+         if err != nil {
+            return nil, fmt.Errorf("stream %s: %w", streamId, err)
+         }
+         stream.add(protection)
+      }
+      for _, contentProtection := range rep.GetContentProtection() {
+         system := drmSystemName(contentProtection.SchemeIdUri)
+         if contentProtection.Pro != "" {
+            pro, err := base64.StdEncoding.DecodeString(strings.TrimSpace(contentProtection.Pro))
+            if err == nil {
+               stream.Pssh = append(stream.Pssh, PsshInfo{System: system, Source: "manifest", Data: pro})
+            }
+         }
+         pssh, err := contentProtection.GetPssh()
+         if err == nil && pssh != nil {
+            stream.Pssh = append(stream.Pssh, PsshInfo{System: system, Source: "manifest", Data: pssh})
+         }
+      }
+      info, err := detectDashType(rep)
+      if err != nil {
+         stream.Err = err
+      } else if info.IsFmp4 {
+         initData, err := getDashInitSegment(rep, info, bases.urls(mpd, rep))
+         if err != nil {
+            return nil, fmt.Errorf("stream %s: %w", streamId, err)
+         }
+         if err := stream.inspectInit(initData); err != nil {
+            return nil, fmt.Errorf("stream %s: %w", streamId, err)
+         }
+      }
+      streams = append(streams, stream)
+   }
+   slices.SortFunc(streams, func(a, b *StreamProtection) int {
+      return strings.Compare(a.StreamId, b.StreamId)
+   })
+   return streams, nil
+}
+
+// InspectHls reports the protection of every stream in an HLS master
+// playlist. Media playlists and init sections are fetched, never media
+// segments.
+func InspectHls(manifestData *Manifest) ([]*StreamProtection, error) {
+   playlist, err := hls.DecodeMaster(string(manifestData.Body), manifestData.Url)
+   if err != nil {
+      return nil, err
+   }
+   sessionKeys := parseHlsKeys(string(manifestData.Body))
+
+   var streams []*StreamProtection
+   inspect := func(streamId string) error {
+      targetUri, err := getHlsStreamUrl(playlist, streamId)
+      if err == nil && targetUri == nil {
+         err = errors.New("stream has no URI")
+      }
+      if err != nil {
+         streams = append(streams, &StreamProtection{StreamId: streamId, Err: err})
+         return nil
+      }
+      mediaPl, err := fetchMediaPlaylist(targetUri)
+      if err != nil {
+         return fmt.Errorf("stream %s: %w", streamId, err)
+      }
+      mediaKeys := mediaPl.keys
+      stream := &StreamProtection{StreamId: streamId}
+      for _, drm := range []DrmSystem{DrmWidevine, DrmPlayReady} {
+         protection, err := getHlsProtection(mediaKeys, sessionKeys, drm)
+         if err != nil {
+            return fmt.Errorf("stream %s: %w", streamId, err)
+         }
+         stream.add(protection)
+      }
+      for _, key := range slices.Concat(mediaKeys, sessionKeys) {
+         switch key.Method {
+         case "SAMPLE-AES-CTR":
+            stream.Scheme = "cenc"
+         case "SAMPLE-AES":
+            // without EXT-X-MAP the segments are MPEG-TS or packed audio,
+            // which use the HLS sample encryption format rather than CENC
+            stream.Scheme = "cbcs"
+            if mediaPl.Map == nil {
+               stream.Scheme = "sample-aes"
+            }
+         case "AES-128":
+            stream.Scheme = "aes-128"
+         }
+         if data, err := key.data(); err == nil && data != nil {
+            stream.Pssh = append(stream.Pssh, PsshInfo{
+               System: drmSystemName(key.KeyFormat), Source: "playlist", Data: data,
+            })
+         }
+      }
+      if mediaPl.Map != nil {
+         initData, err := fetchData(mediaPl.Map, nil, true)
+         if err != nil {
+            return fmt.Errorf("stream %s: %w", streamId, err)
+         }
+         if err := stream.inspectInit(initData); err != nil {
+            return fmt.Errorf("stream %s: %w", streamId, err)
+         }
+      }
+      streams = append(streams, stream)
+      return nil
+   }
+   for _, rendition := range playlist.Medias {
+      if err := inspect(rendition.Id); err != nil {
+         return nil, err
+      }
+   }
+   for _, variant := range playlist.StreamInfs {
+      if err := inspect(variant.Id); err != nil {
+         return nil, err
+      }
+   }
+   return streams, nil
+}
+
+// inspectInit adds the scheme, KID, content ID and PSSH boxes of an init
+// segment, as parsed for decryption.
+func (s *StreamProtection) inspectInit(initData []byte) error {
+   if len(initData) == 0 {
+      return nil
+   }
+   _, initProtection, err := initializeRemuxer(initData, io.Discard)
+   if err != nil {
+      return err
+   }
+   s.add(initProtection)
+   if initProtection != nil && initProtection.Scheme != nil {
+      s.Scheme = initProtection.Scheme.Type
+   }
+   for _, pssh := range findBoxes(initData, "moov", "pssh") {
+      if len(pssh.Payload) < 20 {
+         continue
+      }
+      box := binary.BigEndian.AppendUint32(nil, uint32(8+len(pssh.Payload)))
+      box = append(box, "pssh"...)
+      box = append(box, pssh.Payload...)
+      s.Pssh = append(s.Pssh, PsshInfo{
+         System: drmSystemName(hex.EncodeToString(pssh.Payload[4:20])),
+         Source: "init",
+         Data:   box,
+      })
+   }
+   return nil
+}
+
+// add merges the KID and content ID of protection into the report.
+func (s *StreamProtection) add(protection *protectionInfo) {
+   if protection == nil {
+      return
+   }
+   if protection.KeyId != nil && !slices.ContainsFunc(s.KeyIds, func(keyId []byte) bool {
+      return bytes.Equal(keyId, protection.KeyId)
+   }) {
+      s.KeyIds = append(s.KeyIds, protection.KeyId)
+   }
+   if s.ContentId == nil {
+      s.ContentId = protection.ContentId
+   }
+}
+
+func (s *StreamProtection) String() string {
+   var b strings.Builder
+   fmt.Fprintf(&b, "id = %v", s.StreamId)
+   if s.Scheme != "" {
+      fmt.Fprintf(&b, "\nscheme = %v", s.Scheme)
+   }
+   for _, keyId := range s.KeyIds {
+      fmt.Fprintf(&b, "\nkey ID = %x", keyId)
+   }
+   if s.ContentId != nil {
+      fmt.Fprintf(&b, "\ncontent ID = %x", s.ContentId)
+   }
+   for _, pssh := range s.Pssh {
+      fmt.Fprintf(&b, "\npssh = %v %v %v", pssh.System, pssh.Source,
+         base64.StdEncoding.EncodeToString(pssh.Data),
+      )
+   }
+   if s.Err != nil {
+      fmt.Fprintf(&b, "\nerror = %v", s.Err)
+   } else if s.Scheme == "" && s.KeyIds == nil && s.Pssh == nil {
+      b.WriteString("\nnot protected")
+   }
+   return b.String()
+}
+
+// drmSystemName names a DRM system from a system ID, URN or KEYFORMAT.
+func drmSystemName(system string) string {
+   id := strings.ToLower(system)
+   id = strings.TrimPrefix(id, "urn:uuid:")
+   id = strings.ReplaceAll(id, "-", "")
+   switch id {
+   case widevineSystemId:
+      return "widevine"
+   case playReadySystemId, "79f0049a40988642ab92e65be0885f95", "com.microsoft.playready":
+      return "playready"
+   case "94ce86fb07ff4f43adb893d2fa968ca2", "com.apple.streamingkeydelivery":
+      return "fairplay"
+   case "1077efecc0b24d02ace33c1e52e2fb4b", "org.w3.clearkey":
+      return "clearkey"
+   case "urn:mpeg:dash:mp4protection:2011":
+      return "cenc"
+   }
+   return system
+}
+
+// inspect.go
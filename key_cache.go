@@ -0,0 +1,108 @@
+package maya
+
+import (
+   "encoding/hex"
+   "errors"
+   "io/fs"
+   "log"
+   "time"
+)
+
+// LicenseKey is a content key obtained from a license server.
+type LicenseKey struct {
+   KeyId     string
+   ContentId string
+   Drm       DrmSystem
+   // Backend is the type of the custom DrmBackend the key came from, or
+   // empty for the built-in backend of Drm.
+   Backend string `xml:",omitempty"`
+   Key     string
+   // Expiry is the time after which the key is fetched again. The zero
+   // value never expires.
+   Expiry time.Time
+}
+
+// LicenseKeys is the persistent cache of keys obtained from license
+// servers, stored with the Cache mechanism.
+type LicenseKeys struct {
+   Key []LicenseKey
+}
+
+func (*LicenseKeys) CachePath() string {
+   return "maya/LicenseKeys"
+}
+
+// lookup returns the unexpired key for keyId from the given DRM system and
+// backend.
+func (l *LicenseKeys) lookup(drm DrmSystem, backend string, keyId []byte) []byte {
+   name := hex.EncodeToString(keyId)
+   now := time.Now()
+   for _, item := range l.Key {
+      if item.Drm != drm || item.Backend != backend || item.KeyId != name {
+         continue
+      }
+      if !item.Expiry.IsZero() && now.After(item.Expiry) {
+         continue
+      }
+      key, err := hex.DecodeString(item.Key)
+      if err != nil {
+         continue
+      }
+      return key
+   }
+   return nil
+}
+
+// store adds or replaces the key for keyId from the given DRM system and
+// backend.
+func (l *LicenseKeys) store(item LicenseKey) {
+   for index, current := range l.Key {
+      if current.Drm == item.Drm && current.Backend == item.Backend && current.KeyId == item.KeyId {
+         l.Key[index] = item
+         return
+      }
+   }
+   l.Key = append(l.Key, item)
+}
+
+// cachedKeyFetcher wraps fetch so keys are read from and written to the
+// cache, and the license server is only contacted on a miss.
+func cachedKeyFetcher(cache Cache, drm DrmSystem, backend string, lifetime time.Duration, fetch keyFetcher) keyFetcher {
+   return func(keyId, contentId []byte) ([]ContentKey, error) {
+      var keys LicenseKeys
+      err := cache.Decode(&keys)
+      if err != nil && !errors.Is(err, fs.ErrNotExist) {
+         return nil, err
+      }
+      if key := keys.lookup(drm, backend, keyId); key != nil {
+         log.Printf("key from cache %x: %x", keyId, key)
+         return []ContentKey{{KeyId: keyId, Key: key}}, nil
+      }
+
+      found, err := fetch(keyId, contentId)
+      if err != nil {
+         return nil, err
+      }
+
+      var expiry time.Time
+      if lifetime > 0 {
+         expiry = time.Now().Add(lifetime)
+      }
+      for _, item := range found {
+         keys.store(LicenseKey{
+            KeyId:     hex.EncodeToString(item.KeyId),
+            ContentId: hex.EncodeToString(contentId),
+            Drm:       drm,
+            Backend:   backend,
+            Key:       hex.EncodeToString(item.Key),
+            Expiry:    expiry,
+         })
+      }
+      if err := cache.Encode(&keys); err != nil {
+         return nil, err
+      }
+      return found, nil
+   }
+}
+
+// key_cache.go
@@ -0,0 +1,328 @@
+package maya
+
+import (
+   "bytes"
+   "crypto/aes"
+   "crypto/cipher"
+   "encoding/binary"
+   "encoding/hex"
+   "errors"
+   "fmt"
+)
+
+// keyRing resolves content keys by key ID through a keyFetcher and caches
+// them, so streams using key rotation or per-period keys only request each
+// key once.
+type keyRing struct {
+   fetch     keyFetcher
+   contentId []byte
+   defaultId []byte
+   // groups holds the 'seig' sample group entries declared in the init
+   // segment by track ID, referenced by index from fragment 'sbgp' boxes.
+   groups map[uint32][]seigEntry
+   scheme *protectionScheme
+   blocks map[string]cipher.Block
+   // keys holds the raw key behind each cipher, for record.
+   keys map[string][]byte
+   // record, if set, is called once for every key the stream uses.
+   record   func(ContentKey)
+   recorded map[string]bool
+}
+
+// block returns the cipher for keyId, fetching the key on first use.
+func (k *keyRing) block(keyId []byte) (cipher.Block, error) {
+   name := hex.EncodeToString(keyId)
+   if block, ok := k.blocks[name]; ok {
+      k.markUsed(name, keyId)
+      return block, nil
+   }
+   keys, err := k.fetch(keyId, k.contentId)
+   if err != nil {
+      return nil, fmt.Errorf("failed to fetch decryption key %v: %w", name, err)
+   }
+   if k.blocks == nil {
+      k.blocks = make(map[string]cipher.Block)
+      k.keys = make(map[string][]byte)
+   }
+   // keep every key of the license, other KIDs may appear later in the stream
+   for _, item := range keys {
+      block, err := aes.NewCipher(item.Key)
+      if err != nil {
+         return nil, fmt.Errorf("invalid key for key ID %x: %w", item.KeyId, err)
+      }
+      k.blocks[hex.EncodeToString(item.KeyId)] = block
+      k.keys[hex.EncodeToString(item.KeyId)] = item.Key
+   }
+   block, ok := k.blocks[name]
+   if !ok {
+      return nil, fmt.Errorf("license did not return key ID %v", name)
+   }
+   k.markUsed(name, keyId)
+   return block, nil
+}
+
+// markUsed records a key the first time the stream uses it, whether it came
+// from its own license or from an earlier one.
+func (k *keyRing) markUsed(name string, keyId []byte) {
+   if k.record == nil || k.recorded[name] {
+      return
+   }
+   if k.recorded == nil {
+      k.recorded = make(map[string]bool)
+   }
+   k.recorded[name] = true
+   k.record(ContentKey{KeyId: keyId, Key: k.keys[name]})
+}
+
+// entryBlock returns the cipher for a sample group entry. A nil entry
+// selects the default key and an unprotected entry returns a nil cipher.
+func (k *keyRing) entryBlock(entry *seigEntry) (cipher.Block, error) {
+   if entry == nil {
+      return k.block(k.defaultId)
+   }
+   if !entry.IsProtected {
+      return nil, nil
+   }
+   var zeroKid [16]byte
+   if bytes.Equal(entry.KeyId, zeroKid[:]) {
+      return k.block(k.defaultId)
+   }
+   return k.block(entry.KeyId)
+}
+
+// fragmentCiphers resolves the cipher for every sample of a media segment,
+// following the 'seig' sample groups of each track fragment.
+func (k *keyRing) fragmentCiphers(segmentData []byte) (*fragmentCiphers, error) {
+   ciphers := &fragmentCiphers{}
+   for _, traf := range findBoxes(segmentData, "moof", "traf") {
+      tfhd := findBoxes(traf.Payload, "tfhd")
+      if len(tfhd) == 0 || len(tfhd[0].Payload) < 8 {
+         return nil, errors.New("box 'tfhd' not found")
+      }
+      trackId := binary.BigEndian.Uint32(tfhd[0].Payload[4:])
+      var sampleCount uint32
+      for _, trun := range findBoxes(traf.Payload, "trun") {
+         if len(trun.Payload) < 8 {
+            return nil, errors.New("truncated trun box")
+         }
+         sampleCount += binary.BigEndian.Uint32(trun.Payload[4:])
+      }
+      var local []seigEntry
+      for _, sgpd := range findBoxes(traf.Payload, "sgpd") {
+         entries, err := parseSeigGroup(sgpd.Payload)
+         if err != nil {
+            return nil, err
+         }
+         local = append(local, entries...)
+      }
+      var grouped uint32
+      for _, sbgp := range findBoxes(traf.Payload, "sbgp") {
+         runs, err := parseSeigMapping(sbgp.Payload)
+         if err != nil {
+            return nil, err
+         }
+         for _, run := range runs {
+            entry, err := k.groupEntry(run.groupIndex, trackId, local)
+            if err != nil {
+               return nil, err
+            }
+            block, err := k.entryBlock(entry)
+            if err != nil {
+               return nil, err
+            }
+            ciphers.runs = append(ciphers.runs, cipherRun{
+               count: run.sampleCount, block: block, entry: entry,
+            })
+            grouped += run.sampleCount
+         }
+      }
+      if grouped < sampleCount {
+         block, err := k.block(k.defaultId)
+         if err != nil {
+            return nil, err
+         }
+         ciphers.runs = append(ciphers.runs, cipherRun{count: sampleCount - grouped, block: block})
+      }
+   }
+   if len(ciphers.runs) == 0 {
+      block, err := k.block(k.defaultId)
+      if err != nil {
+         return nil, err
+      }
+      ciphers.fallback = cipherRun{block: block}
+   }
+   return ciphers, nil
+}
+
+// groupEntry maps an 'sbgp' group description index to its 'seig' entry.
+// Indexes above 0x10000 refer to the fragment, others to the trak of
+// trackId in the init segment.
+func (k *keyRing) groupEntry(index, trackId uint32, local []seigEntry) (*seigEntry, error) {
+   const fragmentLocal = 0x10000
+   switch {
+   case index == 0:
+      return nil, nil
+   case index > fragmentLocal:
+      index -= fragmentLocal
+      if int(index) > len(local) {
+         return nil, fmt.Errorf("sample group index %d out of range", index)
+      }
+      return &local[index-1], nil
+   default:
+      groups := k.groups[trackId]
+      if int(index) > len(groups) {
+         return nil, fmt.Errorf("sample group index %d out of range for track %d", index, trackId)
+      }
+      return &groups[index-1], nil
+   }
+}
+
+// cipherRun applies one cipher to a run of consecutive samples. The
+// sample group entry, if any, carries per-group encryption parameters.
+type cipherRun struct {
+   count uint32
+   block cipher.Block
+   entry *seigEntry
+}
+
+// fragmentCiphers hands out the cipher of each sample of a segment in
+// decode order.
+type fragmentCiphers struct {
+   runs     []cipherRun
+   fallback cipherRun
+}
+
+// next returns the cipher run for the next sample. A nil block means the
+// sample is not protected.
+func (f *fragmentCiphers) next() cipherRun {
+   for len(f.runs) > 0 {
+      if f.runs[0].count > 0 {
+         f.runs[0].count--
+         return f.runs[0]
+      }
+      f.runs = f.runs[1:]
+   }
+   return f.fallback
+}
+
+// seigEntry is a CencSampleEncryptionInformationGroupEntry.
+type seigEntry struct {
+   CryptByteBlock  uint8
+   SkipByteBlock   uint8
+   IsProtected     bool
+   PerSampleIvSize uint8
+   KeyId           []byte
+   ConstantIv      []byte
+}
+
+// parseSeigGroup decodes the 'seig' entries of an 'sgpd' box payload.
+// Sample groups of any other grouping type yield no entries.
+func parseSeigGroup(payload []byte) ([]seigEntry, error) {
+   if len(payload) < 8 {
+      return nil, errors.New("truncated sgpd box")
+   }
+   version := payload[0]
+   if string(payload[4:8]) != "seig" {
+      return nil, nil
+   }
+   data := payload[8:]
+   var defaultLength uint32
+   if version == 1 {
+      if len(data) < 4 {
+         return nil, errors.New("truncated sgpd box")
+      }
+      defaultLength = binary.BigEndian.Uint32(data)
+      data = data[4:]
+   }
+   if version >= 2 {
+      if len(data) < 4 {
+         return nil, errors.New("truncated sgpd box")
+      }
+      data = data[4:]
+   }
+   if len(data) < 4 {
+      return nil, errors.New("truncated sgpd box")
+   }
+   entryCount := binary.BigEndian.Uint32(data)
+   data = data[4:]
+
+   var entries []seigEntry
+   for range entryCount {
+      length := defaultLength
+      if version == 1 && defaultLength == 0 {
+         if len(data) < 4 {
+            return nil, errors.New("truncated sgpd entry")
+         }
+         length = binary.BigEndian.Uint32(data)
+         data = data[4:]
+      }
+      if len(data) < 20 {
+         return nil, errors.New("truncated seig entry")
+      }
+      entry := seigEntry{
+         CryptByteBlock:  data[1] >> 4,
+         SkipByteBlock:   data[1] & 0xf,
+         IsProtected:     data[2] == 1,
+         PerSampleIvSize: data[3],
+         KeyId:           data[4:20],
+      }
+      size := uint32(20)
+      if entry.IsProtected && entry.PerSampleIvSize == 0 {
+         if len(data) < 21 || len(data) < 21+int(data[20]) {
+            return nil, errors.New("truncated seig constant IV")
+         }
+         entry.ConstantIv = data[21 : 21+int(data[20])]
+         size = 21 + uint32(data[20])
+      }
+      if length > size {
+         size = length
+      }
+      if int(size) > len(data) {
+         return nil, errors.New("truncated seig entry")
+      }
+      entries = append(entries, entry)
+      data = data[size:]
+   }
+   return entries, nil
+}
+
+// sampleGroupRun is one entry of an 'sbgp' box.
+type sampleGroupRun struct {
+   sampleCount uint32
+   groupIndex  uint32
+}
+
+// parseSeigMapping decodes the runs of an 'sbgp' box payload. Sample
+// groupings of any other grouping type yield no runs.
+func parseSeigMapping(payload []byte) ([]sampleGroupRun, error) {
+   if len(payload) < 8 {
+      return nil, errors.New("truncated sbgp box")
+   }
+   if string(payload[4:8]) != "seig" {
+      return nil, nil
+   }
+   data := payload[8:]
+   if payload[0] == 1 {
+      if len(data) < 4 {
+         return nil, errors.New("truncated sbgp box")
+      }
+      data = data[4:]
+   }
+   if len(data) < 4 {
+      return nil, errors.New("truncated sbgp box")
+   }
+   entryCount := binary.BigEndian.Uint32(data)
+   data = data[4:]
+   if uint64(len(data)) < uint64(entryCount)*8 {
+      return nil, errors.New("truncated sbgp entries")
+   }
+   runs := make([]sampleGroupRun, entryCount)
+   for index := range runs {
+      runs[index].sampleCount = binary.BigEndian.Uint32(data)
+      runs[index].groupIndex = binary.BigEndian.Uint32(data[4:])
+      data = data[8:]
+   }
+   return runs, nil
+}
+
+// keys.go
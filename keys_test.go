@@ -0,0 +1,150 @@
+package maya
+
+import (
+   "bytes"
+   "encoding/binary"
+   "testing"
+)
+
+// seigPayload encodes an sgpd payload of version 1 with the given entries.
+func seigPayload(entries ...[]byte) []byte {
+   data := []byte{1, 0, 0, 0}
+   data = append(data, "seig"...)
+   data = binary.BigEndian.AppendUint32(data, 0)
+   data = binary.BigEndian.AppendUint32(data, uint32(len(entries)))
+   for _, entry := range entries {
+      data = binary.BigEndian.AppendUint32(data, uint32(len(entry)))
+      data = append(data, entry...)
+   }
+   return data
+}
+
+func TestParseSeigGroup(t *testing.T) {
+   keyId := bytes.Repeat([]byte{1}, 16)
+   iv := bytes.Repeat([]byte{2}, 16)
+   constant := append([]byte{0, 0x19, 1, 0}, keyId...)
+   constant = append(append(constant, 16), iv...)
+   perSample := append([]byte{0, 0, 1, 8}, keyId...)
+   clear := make([]byte, 20)
+   entries, err := parseSeigGroup(seigPayload(constant, perSample, clear))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(entries) != 3 {
+      t.Fatalf("%d entries", len(entries))
+   }
+   first := entries[0]
+   if first.CryptByteBlock != 1 || first.SkipByteBlock != 9 || !first.IsProtected {
+      t.Errorf("pattern %d:%d, protected %v", first.CryptByteBlock, first.SkipByteBlock, first.IsProtected)
+   }
+   if !bytes.Equal(first.KeyId, keyId) || !bytes.Equal(first.ConstantIv, iv) {
+      t.Errorf("key ID %x, constant IV %x", first.KeyId, first.ConstantIv)
+   }
+   if entries[1].PerSampleIvSize != 8 || entries[1].ConstantIv != nil {
+      t.Errorf("IV size %d, constant IV %x", entries[1].PerSampleIvSize, entries[1].ConstantIv)
+   }
+   if entries[2].IsProtected {
+      t.Error("clear entry is protected")
+   }
+   other := append([]byte{1, 0, 0, 0}, "roll"...)
+   if entries, err := parseSeigGroup(other); err != nil || entries != nil {
+      t.Errorf("roll group: %v, %v", entries, err)
+   }
+   payload := seigPayload(constant)
+   if _, err := parseSeigGroup(payload[:len(payload)-1]); err == nil {
+      t.Error("truncated entry: no error")
+   }
+}
+
+func TestParseSeigMapping(t *testing.T) {
+   payload := []byte{1, 0, 0, 0}
+   payload = append(payload, "seig"...)
+   payload = binary.BigEndian.AppendUint32(payload, 0)
+   payload = binary.BigEndian.AppendUint32(payload, 2)
+   payload = binary.BigEndian.AppendUint32(payload, 3)
+   payload = binary.BigEndian.AppendUint32(payload, 0x10001)
+   payload = binary.BigEndian.AppendUint32(payload, 5)
+   payload = binary.BigEndian.AppendUint32(payload, 0)
+   runs, err := parseSeigMapping(payload)
+   if err != nil {
+      t.Fatal(err)
+   }
+   want := []sampleGroupRun{{3, 0x10001}, {5, 0}}
+   if len(runs) != len(want) || runs[0] != want[0] || runs[1] != want[1] {
+      t.Errorf("runs = %v", runs)
+   }
+   if _, err := parseSeigMapping(payload[:len(payload)-1]); err == nil {
+      t.Error("truncated: no error")
+   }
+}
+
+func TestGroupEntry(t *testing.T) {
+   ring := &keyRing{groups: map[uint32][]seigEntry{
+      1: {{PerSampleIvSize: 1}},
+      2: {{PerSampleIvSize: 3}, {PerSampleIvSize: 4}},
+   }}
+   local := []seigEntry{{PerSampleIvSize: 2}}
+   tests := []struct {
+      index, trackId uint32
+      want           uint8
+      err            bool
+   }{
+      {1, 1, 1, false},
+      {1, 2, 3, false},
+      {2, 2, 4, false},
+      {0x10001, 1, 2, false},
+      {2, 1, 0, true},
+      {1, 3, 0, true},
+      {0x10002, 1, 0, true},
+   }
+   for _, test := range tests {
+      entry, err := ring.groupEntry(test.index, test.trackId, local)
+      if test.err {
+         if err == nil {
+            t.Errorf("index %#x, track %d: no error", test.index, test.trackId)
+         }
+         continue
+      }
+      if err != nil || entry.PerSampleIvSize != test.want {
+         t.Errorf("index %#x, track %d: %v, %v", test.index, test.trackId, entry, err)
+      }
+   }
+   if entry, err := ring.groupEntry(0, 1, local); entry != nil || err != nil {
+      t.Errorf("index 0: %v, %v", entry, err)
+   }
+}
+
+func TestKeyRingRecord(t *testing.T) {
+   first, second := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)
+   var fetches int
+   var recorded []ContentKey
+   ring := &keyRing{
+      fetch: func(keyId, contentId []byte) ([]ContentKey, error) {
+         fetches++
+         return []ContentKey{
+            {KeyId: first, Key: bytes.Repeat([]byte{3}, 16)},
+            {KeyId: second, Key: bytes.Repeat([]byte{4}, 16)},
+         }, nil
+      },
+      record: func(key ContentKey) {
+         recorded = append(recorded, key)
+      },
+   }
+   // the second KID comes from the license of the first
+   for _, keyId := range [][]byte{first, first, second, second} {
+      if _, err := ring.block(keyId); err != nil {
+         t.Fatal(err)
+      }
+   }
+   if fetches != 1 {
+      t.Errorf("%d fetches", fetches)
+   }
+   if len(recorded) != 2 {
+      t.Fatalf("recorded %d keys", len(recorded))
+   }
+   if !bytes.Equal(recorded[1].KeyId, second) || !bytes.Equal(recorded[1].Key, bytes.Repeat([]byte{4}, 16)) {
+      t.Errorf("second key = %x:%x", recorded[1].KeyId, recorded[1].Key)
+   }
+}
+
+// keys_test.go
@@ -0,0 +1,229 @@
+package maya
+
+import (
+   "bytes"
+   "encoding/base64"
+   "encoding/hex"
+   "encoding/json"
+   "encoding/xml"
+   "errors"
+   "fmt"
+   "io"
+   "log"
+   "net/http"
+   "strings"
+)
+
+// LicenseContext describes one license exchange.
+type LicenseContext struct {
+   Challenge []byte
+   KeyId     []byte
+   ContentId []byte
+   StreamId  string
+   Drm       DrmSystem
+}
+
+// LicenseTransport posts license challenges to a license server, wrapping
+// each challenge and unwrapping each response with Wrapper.
+type LicenseTransport struct {
+   Url    string
+   Header http.Header
+   // Wrapper converts request and response bodies. Nil sends raw bytes.
+   Wrapper LicenseWrapper
+   // Send, if set, replaces the HTTP request, for servers that need more
+   // than a static URL and headers.
+   Send func(ctx *LicenseContext, body []byte) ([]byte, error)
+}
+
+// exchange sends one challenge and returns the unwrapped license.
+func (t *LicenseTransport) exchange(ctx *LicenseContext) ([]byte, error) {
+   wrapper := t.Wrapper
+   if wrapper == nil {
+      wrapper = RawWrapper{}
+   }
+   body, err := wrapper.Wrap(ctx)
+   if err != nil {
+      return nil, err
+   }
+   var response []byte
+   if t.Send != nil {
+      response, err = t.Send(ctx, body)
+   } else {
+      response, err = t.post(body, wrapper.ContentType())
+   }
+   if err != nil {
+      return nil, err
+   }
+   return wrapper.Unwrap(response)
+}
+
+// post sends body to Url with Header and returns the response body.
+func (t *LicenseTransport) post(body []byte, contentType string) ([]byte, error) {
+   req, err := http.NewRequest(http.MethodPost, t.Url, bytes.NewReader(body))
+   if err != nil {
+      return nil, err
+   }
+   if contentType != "" {
+      req.Header.Set("Content-Type", contentType)
+   }
+   for key, values := range t.Header {
+      req.Header[key] = values
+   }
+   log.Println(req.Method, req.URL)
+   resp, err := http.DefaultClient.Do(req)
+   if err != nil {
+      return nil, err
+   }
+   defer resp.Body.Close()
+
+   data, err := io.ReadAll(resp.Body)
+   if err != nil {
+      return nil, err
+   }
+   if resp.StatusCode != http.StatusOK {
+      return nil, fmt.Errorf("license server: %s: %.256s", resp.Status, data)
+   }
+   return data, nil
+}
+
+// LicenseWrapper converts between the challenge and license of a DrmBackend
+// and the bodies exchanged with a license server.
+type LicenseWrapper interface {
+   Wrap(ctx *LicenseContext) ([]byte, error)
+   Unwrap(response []byte) ([]byte, error)
+   ContentType() string
+}
+
+// RawWrapper exchanges the challenge and license as raw bytes.
+type RawWrapper struct{}
+
+func (RawWrapper) Wrap(ctx *LicenseContext) ([]byte, error) {
+   return ctx.Challenge, nil
+}
+
+func (RawWrapper) Unwrap(response []byte) ([]byte, error) {
+   return response, nil
+}
+
+func (RawWrapper) ContentType() string {
+   return "application/octet-stream"
+}
+
+// Base64Wrapper exchanges the challenge and license as base64 text.
+type Base64Wrapper struct{}
+
+func (Base64Wrapper) Wrap(ctx *LicenseContext) ([]byte, error) {
+   return base64.StdEncoding.AppendEncode(nil, ctx.Challenge), nil
+}
+
+func (Base64Wrapper) Unwrap(response []byte) ([]byte, error) {
+   return base64.StdEncoding.DecodeString(strings.TrimSpace(string(response)))
+}
+
+func (Base64Wrapper) ContentType() string {
+   return "text/plain"
+}
+
+// JsonWrapper exchanges the challenge and license as base64 strings inside
+// JSON objects.
+type JsonWrapper struct {
+   // ChallengeField names the request field holding the challenge.
+   ChallengeField string
+   // LicenseField names the response field holding the license. Nested
+   // fields are separated by dots, as in "data.license".
+   LicenseField string
+   // KeyIdField and ContentIdField, if set, add the hex key ID and the
+   // base64 content ID to the request.
+   KeyIdField     string
+   ContentIdField string
+   // Fields are added to every request as is.
+   Fields map[string]any
+}
+
+func (j JsonWrapper) Wrap(ctx *LicenseContext) ([]byte, error) {
+   if j.ChallengeField == "" {
+      return nil, errors.New("JsonWrapper requires a ChallengeField")
+   }
+   value := make(map[string]any, len(j.Fields)+3)
+   for key, field := range j.Fields {
+      value[key] = field
+   }
+   value[j.ChallengeField] = base64.StdEncoding.EncodeToString(ctx.Challenge)
+   if j.KeyIdField != "" {
+      value[j.KeyIdField] = hex.EncodeToString(ctx.KeyId)
+   }
+   if j.ContentIdField != "" {
+      value[j.ContentIdField] = base64.StdEncoding.EncodeToString(ctx.ContentId)
+   }
+   return json.Marshal(value)
+}
+
+func (j JsonWrapper) Unwrap(response []byte) ([]byte, error) {
+   if j.LicenseField == "" {
+      return nil, errors.New("JsonWrapper requires a LicenseField")
+   }
+   var value any
+   if err := json.Unmarshal(response, &value); err != nil {
+      return nil, fmt.Errorf("license response is not JSON: %w", err)
+   }
+   for _, name := range strings.Split(j.LicenseField, ".") {
+      object, ok := value.(map[string]any)
+      if !ok {
+         return nil, fmt.Errorf("license response has no field %q", j.LicenseField)
+      }
+      value, ok = object[name]
+      if !ok {
+         return nil, fmt.Errorf("license response has no field %q", j.LicenseField)
+      }
+   }
+   license, ok := value.(string)
+   if !ok {
+      return nil, fmt.Errorf("license response field %q is not a string", j.LicenseField)
+   }
+   return base64.StdEncoding.DecodeString(license)
+}
+
+func (JsonWrapper) ContentType() string {
+   return "application/json"
+}
+
+// SoapWrapper exchanges PlayReady challenges and licenses as SOAP
+// envelopes. Challenges that are not already enveloped are wrapped, and
+// SOAP faults in the response are returned as errors.
+type SoapWrapper struct{}
+
+func (SoapWrapper) Wrap(ctx *LicenseContext) ([]byte, error) {
+   if bytes.Contains(ctx.Challenge, []byte("Envelope")) {
+      return ctx.Challenge, nil
+   }
+   var body bytes.Buffer
+   body.WriteString(xml.Header)
+   body.WriteString(`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>`)
+   body.Write(ctx.Challenge)
+   body.WriteString(`</soap:Body></soap:Envelope>`)
+   return body.Bytes(), nil
+}
+
+func (SoapWrapper) Unwrap(response []byte) ([]byte, error) {
+   var envelope struct {
+      Body struct {
+         Fault *struct {
+            FaultCode   string `xml:"faultcode"`
+            FaultString string `xml:"faultstring"`
+         }
+      }
+   }
+   if err := xml.Unmarshal(response, &envelope); err != nil {
+      return nil, fmt.Errorf("license response is not a SOAP envelope: %w", err)
+   }
+   if fault := envelope.Body.Fault; fault != nil {
+      return nil, fmt.Errorf("license server fault %s: %s", fault.FaultCode, fault.FaultString)
+   }
+   return response, nil
+}
+
+func (SoapWrapper) ContentType() string {
+   return "text/xml; charset=utf-8"
+}
+
+// license.go
@@ -1,17 +1,19 @@
 package maya
 
 import (
-   "41.neocities.org/diana/playReady"
    "41.neocities.org/diana/widevine"
    "41.neocities.org/sofia"
    "bytes"
    "encoding/hex"
+   "errors"
    "fmt"
+   "io"
    "log"
    "net/url"
    "os"
    "path/filepath"
    "strings"
+   "time"
 )
 
 func createFile(name string) (*os.File, error) {
@@ -25,6 +27,31 @@ func createFile(name string) (*os.File, error) {
 
 // orchestrateDownload contains the shared, high-level logic for executing any download.
 func orchestrateDownload(job *downloadJob) error {
+   if len(job.allRequests) > 0 {
+      job.origin = job.allRequests[0].time
+   }
+   if job.start > 0 || job.end > 0 {
+      if err := job.trim(); err != nil {
+         return err
+      }
+   }
+
+   var ts *tsRemuxer
+   if job.remuxTs && len(job.allRequests) > 0 {
+      var err error
+      ts, err = job.prepareTsRemux()
+      if err != nil {
+         return err
+      }
+   }
+
+   if job.info.Images {
+      return downloadImages(job)
+   }
+   if format := job.subtitleInput(); format != "" {
+      return downloadSubtitles(job, format)
+   }
+
    var name strings.Builder
    name.WriteString(job.outputFileNameBase)
    name.WriteString(job.info.Extension)
@@ -41,6 +68,18 @@ func orchestrateDownload(job *downloadJob) error {
       }
    }
 
+   if job.firstSegment != nil {
+      if cached == nil {
+         cached = job.cachedFirst()
+      } else {
+         cached[0] = job.firstSegment
+      }
+   }
+
+   if ts != nil && len(ts.tracks) > 1 {
+      return downloadMuxedTs(job, ts, cached)
+   }
+
    // Phase 2: Create the file and download all segments.
    // Cached segments from Phase 1 are written from memory;
    // remaining segments are downloaded via the worker pool.
@@ -51,7 +90,12 @@ func orchestrateDownload(job *downloadJob) error {
    defer file.Close()
 
    if !job.info.IsFmp4 {
-      return executeDownload(job.allRequests, nil, nil, file, job.threads, cached)
+      if job.initSegmentData != nil {
+         if _, err := file.Write(job.initSegmentData); err != nil {
+            return err
+         }
+      }
+      return executeDownload(job.allRequests, nil, nil, streamWriter{file}, job.threads, cached, nil)
    }
 
    remux, initProtection, err := initializeRemuxer(job.initSegmentData, file)
@@ -59,17 +103,347 @@ func orchestrateDownload(job *downloadJob) error {
       return err
    }
 
-   var key []byte
+   if ts != nil {
+      // decode times start at the first remuxed segment, so trimmed streams
+      // start at zero as well
+      transform := func(index int, data []byte) ([]byte, error) {
+         return ts.fragment(data, job.allRequests[index].duration)
+      }
+      return executeDownload(job.allRequests, nil, remux, streamWriter{file}, job.threads, cached, transform)
+   }
+
+   var keys *keyRing
    if job.fetchKey != nil {
-      key, err = getKeyForStream(job.fetchKey, job.manifestProtection, initProtection)
+      keys, err = getKeysForStream(job, initProtection)
+      if err != nil {
+         return err
+      }
+   }
+   var transform segmentTransform
+   if len(job.periods) > 1 || job.start > 0 {
+      transform, err = rebaseSegments(job, keys)
+      if err != nil {
+         return err
+      }
+   }
+   return executeDownload(job.allRequests, keys, remux, streamWriter{file}, job.threads, cached, transform)
+}
+
+// downloadMuxedTs remuxes each track of a muxed MPEG-TS stream to its own
+// file, as the remuxer writes one track per file.
+func downloadMuxedTs(job *downloadJob, ts *tsRemuxer, cached map[int][]byte) error {
+   outputs := tsWriter{requests: job.allRequests}
+   used := make(map[string]bool)
+   for _, output := range ts.split() {
+      name := job.outputFileNameBase + output.extension
+      if used[name] {
+         name = fmt.Sprintf("%s_%d%s", job.outputFileNameBase, len(outputs.outputs), output.extension)
+      }
+      used[name] = true
+      file, err := createFile(name)
+      if err != nil {
+         return err
+      }
+      defer file.Close()
+      remux, _, err := initializeRemuxer(output.init, file)
+      if err != nil {
+         return err
+      }
+      outputs.outputs = append(outputs.outputs, output)
+      outputs.remuxers = append(outputs.remuxers, remux)
+   }
+   err := executeDownload(job.allRequests, nil, nil, &outputs, job.threads, cached, nil)
+   if err != nil {
+      return err
+   }
+   for _, remux := range outputs.remuxers {
+      if err := remux.Finish(); err != nil {
+         return err
+      }
+   }
+   return nil
+}
+
+// tsWriter remuxes every segment of a muxed MPEG-TS stream once for each
+// track.
+type tsWriter struct {
+   requests []segment
+   outputs  []*tsOutput
+   remuxers []*sofia.Remuxer
+}
+
+func (t *tsWriter) WriteSegment(index int, data []byte) error {
+   for number, output := range t.outputs {
+      fragment, err := output.ts.fragment(data, t.requests[index].duration)
+      if err != nil {
+         return err
+      }
+      if err := t.remuxers[number].AddSegment(fragment); err != nil {
+         return err
+      }
+   }
+   return nil
+}
+
+// downloadImages writes the segments of an image stream, such as DASH
+// thumbnail tiles, as numbered files in a directory.
+func downloadImages(job *downloadJob) error {
+   err := os.MkdirAll(job.outputFileNameBase, os.ModePerm)
+   if err != nil {
+      return err
+   }
+   log.Println("create:", job.outputFileNameBase)
+   images := &imageWriter{dir: job.outputFileNameBase, extension: job.info.Extension}
+   return executeDownload(job.allRequests, nil, nil, images, job.threads, job.cachedFirst(), nil)
+}
+
+// subtitleInput returns the subtitle format of the stream: vtt, ttml, wvtt
+// or stpp. Other streams return "".
+func (d *downloadJob) subtitleInput() string {
+   if d.info.IsFmp4 {
+      for _, stsd := range findBoxes(d.initSegmentData, "moov", "trak", "mdia", "minf", "stbl", "stsd") {
+         if len(stsd.Payload) >= 16 {
+            switch format := string(stsd.Payload[12:16]); format {
+            case "wvtt", "stpp":
+               return format
+            }
+         }
+      }
+      return ""
+   }
+   switch d.info.Extension {
+   case ".vtt":
+      return "vtt"
+   case ".ttml":
+      return "ttml"
+   }
+   return ""
+}
+
+// downloadSubtitles decodes the segments of a subtitle stream and writes
+// the cues as one SRT or WebVTT file.
+func downloadSubtitles(job *downloadJob, format string) error {
+   output := job.subtitleFormat
+   switch output {
+   case "":
+      output = "vtt"
+   case "vtt", "srt":
+   default:
+      return fmt.Errorf("unsupported subtitle format %q", output)
+   }
+   if len(job.allRequests) == 0 {
+      return errors.New("subtitle stream has no segments")
+   }
+   subtitles := &subtitleWriter{format: format}
+   // the output starts at the first segment kept, as the rebase of media
+   // streams does
+   offset := job.allRequests[0].time
+   for _, seg := range job.allRequests {
+      base := job.origin
+      if len(job.periods) > 0 {
+         period := job.periods[seg.period]
+         base = period.start
+         if period.anchored {
+            base -= period.presentationOffset
+         }
+      }
+      timing := cueSegment{start: secondsToDuration(seg.time - base)}
+      if seg.duration > 0 {
+         timing.end = secondsToDuration(seg.time - base + seg.duration)
+      }
+      if !job.info.IsFmp4 {
+         timing.shift = secondsToDuration(base - offset)
+      }
+      subtitles.segments = append(subtitles.segments, timing)
+   }
+   if job.start > 0 || job.end > 0 {
+      skipped := secondsToDuration(offset - job.origin)
+      subtitles.from = job.start - skipped
+      if job.end > 0 {
+         subtitles.to = job.end - skipped
+      }
+   }
+   var transform segmentTransform
+   if job.info.IsFmp4 {
+      var err error
+      transform, err = rebaseSubtitles(job, subtitles)
       if err != nil {
          return err
       }
    }
-   return executeDownload(job.allRequests, key, remux, file, job.threads, cached)
+   err := executeDownload(job.allRequests, nil, nil, subtitles, job.threads, job.cachedFirst(), transform)
+   if err != nil {
+      return err
+   }
+   file, err := createFile(job.outputFileNameBase + "." + output)
+   if err != nil {
+      return err
+   }
+   defer file.Close()
+   _, err = file.Write(subtitles.encode(output))
+   return err
 }
 
-func initializeRemuxer(firstData []byte, file *os.File) (*sofia.Remuxer, *protectionInfo, error) {
+// rebaseSubtitles rebases the segments of an fMP4 subtitle stream and
+// records the shift of each.
+func rebaseSubtitles(job *downloadJob, subtitles *subtitleWriter) (segmentTransform, error) {
+   sources := job.periods
+   if len(sources) == 0 {
+      sources = []sourcePeriod{{init: job.initSegmentData}}
+   }
+   timings := make([]*trackTiming, len(sources))
+   for index, source := range sources {
+      var err error
+      timings[index], err = parseTrackTiming(source.init)
+      if err != nil {
+         return nil, fmt.Errorf("period %d: %w", index, err)
+      }
+   }
+   subtitles.timing = timings[job.allRequests[0].period]
+   if len(job.periods) <= 1 && job.start <= 0 {
+      return nil, nil
+   }
+   rebase, err := rebaseSegments(job, nil)
+   if err != nil || rebase == nil {
+      return nil, err
+   }
+   return func(index int, data []byte) ([]byte, error) {
+      before, err := fragmentStart(data, timings[job.allRequests[index].period])
+      if err != nil {
+         return nil, err
+      }
+      data, err = rebase(index, data)
+      if err != nil {
+         return nil, err
+      }
+      after, err := fragmentStart(data, subtitles.timing)
+      if err != nil {
+         return nil, err
+      }
+      subtitles.segments[index].shift = after - before
+      return data, nil
+   }, nil
+}
+
+// cachedFirst returns the first segment as cached data for executeDownload,
+// if it was already fetched.
+func (d *downloadJob) cachedFirst() map[int][]byte {
+   if d.firstSegment == nil {
+      return nil
+   }
+   return map[int][]byte{0: d.firstSegment}
+}
+
+// prepareTsRemux probes the first segment of an MPEG-TS stream and switches
+// the job to fragmented MP4 output. The first segment is kept so it is not
+// fetched twice.
+func (d *downloadJob) prepareTsRemux() (*tsRemuxer, error) {
+   if d.firstSegment == nil {
+      var err error
+      d.firstSegment, err = fetchSegment(d.allRequests[0])
+      if err != nil {
+         return nil, err
+      }
+   }
+   ts, initData, err := newTsRemuxer(d.firstSegment)
+   if err != nil {
+      return nil, fmt.Errorf("cannot remux MPEG-TS: %w", err)
+   }
+   d.initSegmentData = initData
+   d.info = &typeInfo{Extension: ".m4a", IsFmp4: true}
+   if ts.hasVideo() {
+      d.info.Extension = ".mp4"
+   }
+   return ts, nil
+}
+
+// rebaseSegments returns a transform that rebases the segments of every
+// period onto one timeline starting at zero, and switches to the key of each
+// period as its segments arrive.
+func rebaseSegments(job *downloadJob, keys *keyRing) (segmentTransform, error) {
+   if !job.info.IsFmp4 || len(job.allRequests) == 0 {
+      return nil, nil
+   }
+   periods := job.periods
+   if len(periods) == 0 {
+      if len(job.initSegmentData) == 0 {
+         log.Print("no init segment, decode times are kept")
+         return nil, nil
+      }
+      periods = []sourcePeriod{{init: job.initSegmentData}}
+   }
+   timings := make([]map[uint32]*trackTiming, len(periods))
+   keyIds := make([][]byte, len(periods))
+   for index, period := range periods {
+      timing, err := parseTrackTimings(period.init)
+      if err != nil {
+         return nil, fmt.Errorf("period %d: %w", index, err)
+      }
+      timings[index] = timing
+      if keys != nil {
+         _, protection, err := initializeRemuxer(period.init, io.Discard)
+         if err != nil {
+            return nil, fmt.Errorf("period %d: %w", index, err)
+         }
+         if protection != nil {
+            keyIds[index] = protection.KeyId
+         }
+      }
+   }
+   line := timeline{offset: job.allRequests[0].time}
+   return func(index int, data []byte) ([]byte, error) {
+      seg := &job.allRequests[index]
+      if keys != nil && keyIds[seg.period] != nil {
+         keys.defaultId = keyIds[seg.period]
+      }
+      err := line.rebase(data, seg, &periods[seg.period], timings[seg.period])
+      if err != nil {
+         return nil, fmt.Errorf("period %d: %w", seg.period, err)
+      }
+      return data, nil
+   }, nil
+}
+
+// trim keeps only the segments overlapping the start and end of the job,
+// using the time and duration of each segment.
+func (d *downloadJob) trim() error {
+   if d.end > 0 && d.end <= d.start {
+      return fmt.Errorf("end %v is not after start %v", d.end, d.start)
+   }
+   if len(d.allRequests) == 0 {
+      return errors.New("cannot trim: stream has no segments")
+   }
+   start, end := d.start.Seconds(), d.end.Seconds()
+   var kept []segment
+   var position float64
+   keptFirst := false
+   for index, seg := range d.allRequests {
+      if seg.duration <= 0 {
+         return errors.New("cannot trim: segment duration is unknown")
+      }
+      segStart := seg.time - d.origin
+      position = segStart + seg.duration
+      if position <= start {
+         continue
+      }
+      if end > 0 && segStart >= end {
+         break
+      }
+      keptFirst = keptFirst || index == 0
+      kept = append(kept, seg)
+   }
+   if len(kept) == 0 {
+      return fmt.Errorf("no segments between %v and %v; stream is %.3fs", d.start, d.end, position)
+   }
+   log.Printf("trim: %d of %d segments", len(kept), len(d.allRequests))
+   if !keptFirst {
+      d.firstSegment = nil
+   }
+   d.allRequests = kept
+   return nil
+}
+
+func initializeRemuxer(firstData []byte, file io.Writer) (*sofia.Remuxer, *protectionInfo, error) {
    var remux sofia.Remuxer
    remux.Writer = file
    if len(firstData) > 0 {
@@ -94,17 +468,17 @@ func initializeRemuxer(firstData []byte, file *os.File) (*sofia.Remuxer, *protec
          wv_data, err := widevine.DecodePsshData(pssh.Data)
          if err == nil {
             initProtection.ContentId = wv_data.ContentId
+            initProtection.Pssh = encodePsshBox(wvIdBytes, pssh.Data)
          }
       }
       if initProtection.ContentId == nil {
          if pssh, ok := remux.Moov.FindPssh(prIdBytes); ok {
-            wrm, err := playReady.ParsePro(pssh.Data)
+            pro, err := parsePlayReadyObject(pssh.Data)
             if err != nil {
-               return nil, nil, fmt.Errorf("failed to parse PlayReady PRO: %w", err)
-            }
-            if wrm.Data.CustomAttributes != nil {
-               initProtection.ContentId = []byte(wrm.Data.CustomAttributes.ContentId)
+               return nil, nil, err
             }
+            initProtection.ContentId = pro.ContentId
+            initProtection.Pssh = encodePsshBox(prIdBytes, pssh.Data)
          }
       }
 
@@ -128,6 +502,28 @@ func initializeRemuxer(firstData []byte, file *os.File) (*sofia.Remuxer, *protec
             }
          }
       }
+      // sbgp indexes refer to the sgpd of their own trak
+      for _, trak := range findBoxes(firstData, "moov", "trak") {
+         trackId, err := readTrackId(trak.Payload)
+         if err != nil {
+            return nil, nil, err
+         }
+         for _, sgpd := range findBoxes(trak.Payload, "mdia", "minf", "stbl", "sgpd") {
+            entries, err := parseSeigGroup(sgpd.Payload)
+            if err != nil {
+               return nil, nil, fmt.Errorf("failed to parse init segment sample groups: %w", err)
+            }
+            if initProtection.SampleGroups == nil {
+               initProtection.SampleGroups = make(map[uint32][]seigEntry)
+            }
+            initProtection.SampleGroups[trackId] = append(initProtection.SampleGroups[trackId], entries...)
+         }
+      }
+      scheme, err := parseProtectionScheme(firstData)
+      if err != nil {
+         return nil, nil, fmt.Errorf("failed to parse protection scheme: %w", err)
+      }
+      initProtection.Scheme = scheme
       remux.Moov.RemovePssh()
    }
    return &remux, initProtection, nil
@@ -143,6 +539,36 @@ type downloadJob struct {
    threads            int
    fetchKey           keyFetcher
    minBitrate         int
+   drm                DrmSystem
+   result             *DownloadResult
+   licenseUrl         string
+   // subtitleFormat is the output of subtitle streams, "vtt" or "srt".
+   subtitleFormat string
+   // periods holds each source period. Segments refer to it by index;
+   // single-period jobs leave it empty.
+   periods []sourcePeriod
+   // remuxTs converts MPEG-TS segments to fragmented MP4.
+   remuxTs bool
+   // start and end limit the download to a time range, from origin.
+   start time.Duration
+   end   time.Duration
+   // origin is the time of the first segment before trimming, in seconds.
+   origin float64
+   // firstSegment is the data of the first segment, if it was already
+   // fetched to detect the type of the stream.
+   firstSegment []byte
+}
+
+// sourcePeriod is one period of a multi-period stream.
+type sourcePeriod struct {
+   init []byte
+   // start is where the period begins, in seconds on the timeline of the
+   // segment times.
+   start float64
+   // anchored periods begin at presentationOffset, in seconds of decode
+   // time. Other periods begin at the decode time of their first segment.
+   anchored           bool
+   presentationOffset float64
 }
 
 // segment represents a single chunk to be downloaded.
@@ -151,12 +577,32 @@ type segment struct {
    headers  map[string]string
    duration float64
    sizeBits uint64
+   period   int
+   // time is the start of the segment in seconds, counted from the first
+   // period.
+   time float64
+   // mirrors are the same segment on other CDNs, tried in order if url
+   // fails.
+   mirrors []*url.URL
+   // failover, if set, returns more mirrors. It is called only once url
+   // and mirrors have failed.
+   failover func() []*url.URL
 }
 
 // typeInfo holds the determined properties of a media stream
 type typeInfo struct {
    Extension string
    IsFmp4    bool
+   // Codecs is the codecs attribute of the stream, if known.
+   Codecs string
+   // Images streams are written as one file per segment.
+   Images bool
+}
+
+// hasInit reports whether segments need an initialization segment: fMP4
+// and WebM.
+func (t *typeInfo) hasInit() bool {
+   return t.IsFmp4 || t.Extension == ".webm"
 }
 
 // orchestrator.go
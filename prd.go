@@ -0,0 +1,132 @@
+package maya
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "os"
+   "path/filepath"
+)
+
+// playReadyDevice is a PlayReady certificate chain with the raw signing and
+// encryption private keys.
+type playReadyDevice struct {
+   Chain      []byte
+   SigningKey []byte
+   EncryptKey []byte
+}
+
+// loadPlayReadyDevice reads a device from a .prd file, or from a directory
+// holding bdevcert.dat, zprivsig.dat and zprivencr.dat.
+func loadPlayReadyDevice(device string) (*playReadyDevice, error) {
+   stat, err := os.Stat(device)
+   if err != nil {
+      return nil, err
+   }
+   if !stat.IsDir() {
+      data, err := os.ReadFile(device)
+      if err != nil {
+         return nil, err
+      }
+      prd, err := parsePrd(data)
+      if err != nil {
+         return nil, fmt.Errorf("invalid PRD file %s: %w", device, err)
+      }
+      return prd, nil
+   }
+
+   var prd playReadyDevice
+   files := []struct {
+      name  string
+      value *[]byte
+   }{
+      {"bdevcert.dat", &prd.Chain},
+      {"zprivsig.dat", &prd.SigningKey},
+      {"zprivencr.dat", &prd.EncryptKey},
+   }
+   for _, file := range files {
+      *file.value, err = os.ReadFile(filepath.Join(device, file.name))
+      if err != nil {
+         return nil, err
+      }
+   }
+   return &prd, nil
+}
+
+// parsePrd decodes a PRD device file. Version 2 holds the certificate chain
+// followed by the encryption and signing keys, version 3 prepends the group
+// key and moves the chain to the end. Each key is 32 private bytes followed
+// by 64 public bytes.
+func parsePrd(data []byte) (*playReadyDevice, error) {
+   if len(data) < 4 || string(data[:3]) != "PRD" {
+      return nil, errors.New("missing PRD signature")
+   }
+   version := data[3]
+   data = data[4:]
+
+   const keySize = 96
+   var device playReadyDevice
+   var err error
+   switch version {
+   case 2:
+      device.Chain, data, err = readPrdChain(data)
+      if err != nil {
+         return nil, err
+      }
+      device.EncryptKey, data, err = readPrdKey(data, "encryption key")
+      if err != nil {
+         return nil, err
+      }
+      device.SigningKey, _, err = readPrdKey(data, "signing key")
+      if err != nil {
+         return nil, err
+      }
+   case 3:
+      if len(data) < keySize {
+         return nil, errors.New("group key is missing or truncated")
+      }
+      data = data[keySize:]
+      device.EncryptKey, data, err = readPrdKey(data, "encryption key")
+      if err != nil {
+         return nil, err
+      }
+      device.SigningKey, data, err = readPrdKey(data, "signing key")
+      if err != nil {
+         return nil, err
+      }
+      device.Chain, _, err = readPrdChain(data)
+      if err != nil {
+         return nil, err
+      }
+   default:
+      return nil, fmt.Errorf("unsupported PRD version %d", version)
+   }
+   return &device, nil
+}
+
+// readPrdChain reads the certificate chain prefixed with its 32-bit length.
+func readPrdChain(data []byte) ([]byte, []byte, error) {
+   if len(data) < 4 {
+      return nil, nil, errors.New("certificate chain is missing")
+   }
+   size := binary.BigEndian.Uint32(data)
+   data = data[4:]
+   if size == 0 || uint64(size) > uint64(len(data)) {
+      return nil, nil, fmt.Errorf("certificate chain is truncated: %d of %d bytes", len(data), size)
+   }
+   if string(data[:min(4, size)]) != "CHAI" {
+      return nil, nil, errors.New("certificate chain is malformed: missing CHAI signature")
+   }
+   return data[:size], data[size:], nil
+}
+
+// readPrdKey reads a 96-byte key pair and returns its private part.
+func readPrdKey(data []byte, name string) ([]byte, []byte, error) {
+   const keySize = 96
+   if len(data) < keySize {
+      return nil, nil, fmt.Errorf("%s is missing or truncated", name)
+   }
+   return data[:32], data[keySize:], nil
+}
+
+// prd.go
@@ -0,0 +1,59 @@
+package maya
+
+import (
+   "bytes"
+   "encoding/binary"
+   "testing"
+)
+
+// prdKey returns a 96-byte key pair whose private part is filled with b.
+func prdKey(b byte) []byte {
+   key := bytes.Repeat([]byte{b}, 32)
+   return append(key, make([]byte, 64)...)
+}
+
+func prdChain() []byte {
+   chain := []byte("CHAI certificates")
+   return append(binary.BigEndian.AppendUint32(nil, uint32(len(chain))), chain...)
+}
+
+func TestParsePrd(t *testing.T) {
+   tests := map[string][]byte{
+      "version 2": bytes.Join([][]byte{[]byte("PRD\x02"), prdChain(), prdKey(1), prdKey(2)}, nil),
+      "version 3": bytes.Join([][]byte{[]byte("PRD\x03"), prdKey(9), prdKey(1), prdKey(2), prdChain()}, nil),
+   }
+   for name, data := range tests {
+      device, err := parsePrd(data)
+      if err != nil {
+         t.Fatalf("%s: %v", name, err)
+      }
+      if string(device.Chain) != "CHAI certificates" {
+         t.Errorf("%s: chain = %q", name, device.Chain)
+      }
+      if !bytes.Equal(device.EncryptKey, prdKey(1)[:32]) {
+         t.Errorf("%s: encryption key = %x", name, device.EncryptKey)
+      }
+      if !bytes.Equal(device.SigningKey, prdKey(2)[:32]) {
+         t.Errorf("%s: signing key = %x", name, device.SigningKey)
+      }
+   }
+}
+
+func TestParsePrdErrors(t *testing.T) {
+   badChain := binary.BigEndian.AppendUint32(nil, 4)
+   badChain = append(badChain, "XXXX"...)
+   tests := map[string][]byte{
+      "signature": []byte("PRX\x02"),
+      "version":   []byte("PRD\x04"),
+      "chain":     bytes.Join([][]byte{[]byte("PRD\x02"), badChain, prdKey(1), prdKey(2)}, nil),
+      "truncated": bytes.Join([][]byte{[]byte("PRD\x02"), prdChain(), prdKey(1), prdKey(2)[:50]}, nil),
+      "group key": []byte("PRD\x03short"),
+   }
+   for name, data := range tests {
+      if _, err := parsePrd(data); err == nil {
+         t.Errorf("%s: no error", name)
+      }
+   }
+}
+
+// prd_test.go
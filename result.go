@@ -0,0 +1,79 @@
+package maya
+
+import (
+   "encoding/base64"
+   "fmt"
+   "log"
+   "os"
+   "strings"
+)
+
+// KeyRecord is a content key used by a download, with the DRM data it was
+// obtained from.
+type KeyRecord struct {
+   StreamId string
+   KeyId    []byte
+   Key      []byte
+   Drm      DrmSystem
+   // Pssh is the pssh box sent in the license request, if known.
+   Pssh       []byte
+   LicenseUrl string
+}
+
+// PsshBase64 returns the pssh box in base64, as taken by most tools.
+func (k *KeyRecord) PsshBase64() string {
+   return base64.StdEncoding.EncodeToString(k.Pssh)
+}
+
+// DownloadResult collects the key material of downloads.
+type DownloadResult struct {
+   Keys []KeyRecord
+}
+
+// unique returns the records with duplicate KIDs removed.
+func (d *DownloadResult) unique() []KeyRecord {
+   var records []KeyRecord
+   seen := make(map[string]bool)
+   for _, record := range d.Keys {
+      name := fmt.Sprintf("%x", record.KeyId)
+      if !seen[name] {
+         seen[name] = true
+         records = append(records, record)
+      }
+   }
+   return records
+}
+
+// Mp4decryptArgs returns the --key arguments for Bento4 mp4decrypt.
+func (d *DownloadResult) Mp4decryptArgs() []string {
+   var args []string
+   for _, record := range d.unique() {
+      args = append(args, "--key", fmt.Sprintf("%x:%x", record.KeyId, record.Key))
+   }
+   return args
+}
+
+// ShakaKeys returns the value of the shaka-packager --keys flag, used with
+// --enable_raw_key_decryption. Each key is labelled with its stream ID.
+func (d *DownloadResult) ShakaKeys() string {
+   var keys []string
+   for _, record := range d.unique() {
+      keys = append(keys, fmt.Sprintf("label=%s:key_id=%x:key=%x",
+         record.StreamId, record.KeyId, record.Key,
+      ))
+   }
+   return strings.Join(keys, ",")
+}
+
+// WriteKeyFile writes one KID:KEY line per key, the format read by
+// Options.KeyFile.
+func (d *DownloadResult) WriteKeyFile(name string) error {
+   var data strings.Builder
+   for _, record := range d.unique() {
+      fmt.Fprintf(&data, "%x:%x\n", record.KeyId, record.Key)
+   }
+   log.Println("create:", name)
+   return os.WriteFile(name, []byte(data.String()), os.ModePerm)
+}
+
+// result.go
@@ -0,0 +1,581 @@
+package maya
+
+import (
+   "bytes"
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "log"
+   "regexp"
+   "slices"
+   "strconv"
+   "strings"
+   "time"
+)
+
+// cue is one subtitle cue. Times are from the start of the stream.
+type cue struct {
+   start, end time.Duration
+   // settings are WebVTT cue settings, such as "line:0".
+   settings string
+   // text is the cue payload, with WebVTT markup.
+   text string
+}
+
+// subtitleWriter decodes the segments of a subtitle stream into cues.
+type subtitleWriter struct {
+   // format is the input format: vtt, ttml, wvtt or stpp.
+   format string
+   timing *trackTiming
+   cues   []cue
+   // mapped and mapBase hold the X-TIMESTAMP-MAP of the first HLS WebVTT
+   // segment, to which later segments are normalised.
+   mapped  bool
+   mapBase time.Duration
+   // segments places the cues of each segment.
+   segments []cueSegment
+   // from and to are the output range; cues outside it are cut. A zero to
+   // means no end.
+   from, to time.Duration
+   // blocks are the STYLE and REGION blocks of the first WebVTT header.
+   blocks []string
+   // trackTimed is set once a segment is seen timed from the stream.
+   trackTimed bool
+}
+
+// cueSegment is the timing of one subtitle segment.
+type cueSegment struct {
+   // start and end bound the segment in its period. A zero end is unknown.
+   start, end time.Duration
+   // shift moves the cues to the output timeline.
+   shift time.Duration
+}
+
+// WriteSegment decodes a segment and moves its cues to the output
+// timeline. wvtt samples are already there.
+func (s *subtitleWriter) WriteSegment(index int, data []byte) error {
+   segment := s.segment(index)
+   var cues []cue
+   var err error
+   switch s.format {
+   case "vtt":
+      cues, err = s.parseVtt(index, data)
+   case "ttml":
+      cues, err = s.parseTtml(data, segment.start, segment.end)
+   case "wvtt", "stpp":
+      cues, err = s.parseFragment(index, data)
+   default:
+      err = fmt.Errorf("unsupported subtitle format %v", s.format)
+   }
+   if err != nil {
+      return err
+   }
+   if s.format != "wvtt" {
+      for index := range cues {
+         cues[index].start += segment.shift
+         cues[index].end += segment.shift
+      }
+   }
+   s.cues = append(s.cues, cues...)
+   return nil
+}
+
+// segment returns the timing of the segment at index, or zero if unknown.
+func (s *subtitleWriter) segment(index int) cueSegment {
+   if index < len(s.segments) {
+      return s.segments[index]
+   }
+   return cueSegment{}
+}
+
+// relativeTo reports whether the cues of the segment from start to end are
+// timed from it rather than the stream. They must all fit within its
+// length, and no earlier segment may have been timed from the stream.
+func (s *subtitleWriter) relativeTo(cues []cue, start, end time.Duration) bool {
+   if start <= 0 || s.trackTimed {
+      return false
+   }
+   relative := true
+   for _, item := range cues {
+      last := max(item.start, item.end)
+      if last >= start {
+         s.trackTimed = true
+         return false
+      }
+      if end > start && last > end-start {
+         relative = false
+      }
+   }
+   return relative
+}
+
+// parseVtt decodes a WebVTT document or segment. Cues are shifted by its
+// X-TIMESTAMP-MAP, relative to that of the first segment.
+func (s *subtitleWriter) parseVtt(index int, data []byte) ([]cue, error) {
+   document, err := parseWebVtt(data)
+   if err != nil {
+      return nil, err
+   }
+   if index == 0 {
+      s.blocks = document.blocks
+   }
+   segment := s.segment(index)
+   relative := s.relativeTo(document.cues, segment.start, segment.end)
+   var offset time.Duration
+   if document.hasMap {
+      if !s.mapped {
+         s.mapBase = document.mapOffset
+         if relative {
+            s.mapBase -= segment.start
+         }
+         s.mapped = true
+      }
+      offset = document.mapOffset - s.mapBase
+   } else if relative {
+      offset = segment.start
+   }
+   for index := range document.cues {
+      document.cues[index].start += offset
+      document.cues[index].end += offset
+   }
+   return document.cues, nil
+}
+
+// parseFragment decodes the wvtt or stpp samples of an fMP4 segment, which
+// are timed on the output timeline.
+func (s *subtitleWriter) parseFragment(index int, data []byte) ([]cue, error) {
+   if s.timing == nil {
+      return nil, errors.New("subtitle track has no init segment")
+   }
+   samples, err := fragmentSamples(data)
+   if err != nil {
+      return nil, err
+   }
+   var cues []cue
+   for _, sample := range samples {
+      start := ticksToDuration(sample.start, s.timing.timescale)
+      end := ticksToDuration(sample.start+sample.duration, s.timing.timescale)
+      var sampleCues []cue
+      if s.format == "wvtt" {
+         sampleCues, err = parseWvttSample(sample.data, start, end)
+      } else {
+         shift := s.segment(index).shift
+         sampleCues, err = s.parseTtml(sample.data, start-shift, end-shift)
+      }
+      if err != nil {
+         return nil, err
+      }
+      cues = append(cues, sampleCues...)
+   }
+   return cues, nil
+}
+
+// fragmentStart returns the decode time of the first fragment of an fMP4
+// segment.
+func fragmentStart(data []byte, timing *trackTiming) (time.Duration, error) {
+   tfdt := findBoxes(data, "moof", "traf", "tfdt")
+   if len(tfdt) == 0 {
+      return 0, errors.New("box 'tfdt' not found")
+   }
+   decodeTime, err := readTfdt(tfdt[0].Payload)
+   if err != nil {
+      return 0, err
+   }
+   return ticksToDuration(decodeTime, timing.timescale), nil
+}
+
+// encode writes the cues in the output format, srt or vtt.
+func (s *subtitleWriter) encode(output string) []byte {
+   s.clip()
+   slices.SortStableFunc(s.cues, func(a, b cue) int {
+      return int(a.start - b.start)
+   })
+   s.mergeCues()
+   var b bytes.Buffer
+   if output == "vtt" {
+      b.WriteString("WEBVTT\n")
+      for _, block := range s.blocks {
+         b.WriteString("\n" + block + "\n")
+      }
+   }
+   var index int
+   for _, item := range s.cues {
+      text := strings.TrimSpace(item.text)
+      if text == "" || item.end <= item.start {
+         continue
+      }
+      index++
+      b.WriteByte('\n')
+      if output == "srt" {
+         fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n", index,
+            formatCueTime(item.start, ','), formatCueTime(item.end, ','), srtText(text),
+         )
+         continue
+      }
+      fmt.Fprintf(&b, "%s --> %s", formatCueTime(item.start, '.'), formatCueTime(item.end, '.'))
+      if item.settings != "" {
+         b.WriteString(" " + item.settings)
+      }
+      b.WriteString("\n" + text + "\n")
+   }
+   return b.Bytes()
+}
+
+// clip cuts the cues to the output range, dropping those outside it.
+func (s *subtitleWriter) clip() {
+   var kept []cue
+   for _, item := range s.cues {
+      item.start = max(item.start, s.from)
+      if s.to > 0 {
+         item.end = min(item.end, s.to)
+      }
+      if item.end > item.start {
+         kept = append(kept, item)
+      }
+   }
+   s.cues = kept
+}
+
+// mergeCues removes the copies of cues that span segments. A cue repeated
+// with the same times is dropped, and a cue continued in the next segment,
+// with the same text starting where the first ends, is joined to it.
+func (s *subtitleWriter) mergeCues() {
+   var merged []cue
+   for _, item := range s.cues {
+      duplicate := false
+      for index := len(merged) - 1; index >= 0; index-- {
+         previous := &merged[index]
+         if previous.end < item.start {
+            continue
+         }
+         if previous.text != item.text || previous.settings != item.settings {
+            continue
+         }
+         if previous.start == item.start || previous.end == item.start {
+            previous.end = max(previous.end, item.end)
+            duplicate = true
+            break
+         }
+      }
+      if !duplicate {
+         merged = append(merged, item)
+      }
+   }
+   s.cues = merged
+}
+
+func formatCueTime(value time.Duration, separator byte) string {
+   value = max(value, 0)
+   millis := value.Milliseconds()
+   return fmt.Sprintf("%02d:%02d:%02d%c%03d",
+      millis/3600000, millis/60000%60, millis/1000%60, separator, millis%1000,
+   )
+}
+
+var vttTag = regexp.MustCompile(`</?([a-z]+)[^>]*>`)
+
+// srtText keeps the i, b and u tags of WebVTT text, which SRT players
+// understand, and drops the rest.
+func srtText(text string) string {
+   text = vttTag.ReplaceAllStringFunc(text, func(tag string) string {
+      name := vttTag.FindStringSubmatch(tag)[1]
+      switch name {
+      case "i", "b", "u":
+         if strings.HasPrefix(tag, "</") {
+            return "</" + name + ">"
+         }
+         return "<" + name + ">"
+      }
+      return ""
+   })
+   text = strings.ReplaceAll(text, "&lt;", "<")
+   text = strings.ReplaceAll(text, "&gt;", ">")
+   text = strings.ReplaceAll(text, "&nbsp;", " ")
+   return strings.ReplaceAll(text, "&amp;", "&")
+}
+
+func ticksToDuration(ticks uint64, timescale uint32) time.Duration {
+   seconds := ticks / uint64(timescale)
+   rest := ticks % uint64(timescale)
+   return time.Duration(seconds)*time.Second + time.Duration(rest)*time.Second/time.Duration(timescale)
+}
+
+// webVtt is a parsed WebVTT document.
+type webVtt struct {
+   cues []cue
+   // mapOffset is the time of LOCAL in the X-TIMESTAMP-MAP header, as a
+   // shift from local cue times to MPEG-TS time.
+   mapOffset time.Duration
+   hasMap    bool
+   // blocks are the STYLE and REGION blocks, as written.
+   blocks []string
+}
+
+// parseWebVtt decodes the cues of a WebVTT document. STYLE and REGION
+// blocks are kept as written; NOTE blocks are skipped.
+func parseWebVtt(data []byte) (*webVtt, error) {
+   text := strings.ReplaceAll(string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))), "\r\n", "\n")
+   blocks := strings.Split(strings.ReplaceAll(text, "\r", "\n"), "\n\n")
+   if !strings.HasPrefix(blocks[0], "WEBVTT") {
+      return nil, errors.New("missing WEBVTT header")
+   }
+   var document webVtt
+   for line := range strings.SplitSeq(blocks[0], "\n") {
+      if value, ok := strings.CutPrefix(line, "X-TIMESTAMP-MAP="); ok {
+         offset, err := parseTimestampMap(value)
+         if err != nil {
+            return nil, err
+         }
+         document.mapOffset, document.hasMap = offset, true
+      }
+   }
+   for _, block := range blocks[1:] {
+      block = strings.Trim(block, "\n")
+      if strings.HasPrefix(block, "STYLE") || strings.HasPrefix(block, "REGION") {
+         if !strings.Contains(block, "-->") {
+            document.blocks = append(document.blocks, block)
+            continue
+         }
+      }
+      lines := strings.Split(block, "\n")
+      timing := slices.IndexFunc(lines, func(line string) bool {
+         return strings.Contains(line, "-->")
+      })
+      if timing < 0 || timing > 1 {
+         continue
+      }
+      item, err := parseCueTiming(lines[timing])
+      if err != nil {
+         log.Printf("skip cue: %v", err)
+         continue
+      }
+      item.text = strings.Join(lines[timing+1:], "\n")
+      document.cues = append(document.cues, *item)
+   }
+   return &document, nil
+}
+
+// parseTimestampMap returns MPEGTS minus LOCAL of an X-TIMESTAMP-MAP value.
+func parseTimestampMap(value string) (time.Duration, error) {
+   var mpegts uint64
+   var local time.Duration
+   for field := range strings.SplitSeq(value, ",") {
+      name, fieldValue, _ := strings.Cut(strings.TrimSpace(field), ":")
+      var err error
+      switch name {
+      case "MPEGTS":
+         mpegts, err = strconv.ParseUint(fieldValue, 10, 64)
+      case "LOCAL":
+         local, err = parseVttTime(fieldValue)
+      }
+      if err != nil {
+         return 0, fmt.Errorf("invalid X-TIMESTAMP-MAP %q: %w", value, err)
+      }
+   }
+   return ticksToDuration(mpegts, 90000) - local, nil
+}
+
+func parseCueTiming(line string) (*cue, error) {
+   start, rest, _ := strings.Cut(line, "-->")
+   fields := strings.Fields(rest)
+   if len(fields) == 0 {
+      return nil, fmt.Errorf("invalid cue timing %q", line)
+   }
+   var item cue
+   var err error
+   item.start, err = parseVttTime(strings.TrimSpace(start))
+   if err != nil {
+      return nil, err
+   }
+   item.end, err = parseVttTime(fields[0])
+   if err != nil {
+      return nil, err
+   }
+   item.settings = strings.Join(fields[1:], " ")
+   return &item, nil
+}
+
+// parseVttTime parses hh:mm:ss.ttt or mm:ss.ttt. A comma is accepted as
+// the decimal separator too.
+func parseVttTime(value string) (time.Duration, error) {
+   parts := strings.Split(strings.ReplaceAll(value, ",", "."), ":")
+   if len(parts) < 2 || len(parts) > 3 {
+      return 0, fmt.Errorf("invalid timestamp %q", value)
+   }
+   seconds, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+   if err != nil {
+      return 0, fmt.Errorf("invalid timestamp %q", value)
+   }
+   total := time.Duration(seconds * float64(time.Second))
+   for index, unit := range []time.Duration{time.Minute, time.Hour}[:len(parts)-1] {
+      count, err := strconv.Atoi(parts[len(parts)-2-index])
+      if err != nil {
+         return 0, fmt.Errorf("invalid timestamp %q", value)
+      }
+      total += time.Duration(count) * unit
+   }
+   return total.Round(time.Millisecond), nil
+}
+
+// parseWvttSample decodes the vttc boxes of a wvtt sample. An empty vtte
+// sample has no cues.
+func parseWvttSample(data []byte, start, end time.Duration) ([]cue, error) {
+   boxes, err := readBoxes(data)
+   if err != nil {
+      return nil, fmt.Errorf("wvtt sample: %w", err)
+   }
+   var cues []cue
+   for _, box := range boxes {
+      if box.Type != "vttc" {
+         continue
+      }
+      children, err := readBoxes(box.Payload)
+      if err != nil {
+         return nil, fmt.Errorf("vttc box: %w", err)
+      }
+      item := cue{start: start, end: end}
+      for _, child := range children {
+         switch child.Type {
+         case "payl":
+            item.text = string(child.Payload)
+         case "sttg":
+            item.settings = string(child.Payload)
+         }
+      }
+      cues = append(cues, item)
+   }
+   return cues, nil
+}
+
+// textSample is one sample of a fragmented text track, timed in the track
+// timescale.
+type textSample struct {
+   start, duration uint64
+   data            []byte
+}
+
+// fragmentSamples returns the samples of the first track of each fragment
+// in an fMP4 segment.
+func fragmentSamples(data []byte) ([]textSample, error) {
+   var samples []textSample
+   for offset := 0; offset+8 <= len(data); {
+      size := int(binary.BigEndian.Uint32(data[offset:]))
+      if size == 0 {
+         size = len(data) - offset
+      }
+      if size < 8 || offset+size > len(data) {
+         return nil, errors.New("invalid box size in text segment")
+      }
+      if string(data[offset+4:offset+8]) == "moof" {
+         moofSamples, err := moofSamples(data, offset, size)
+         if err != nil {
+            return nil, err
+         }
+         samples = append(samples, moofSamples...)
+      }
+      offset += size
+   }
+   return samples, nil
+}
+
+// moofSamples reads the samples of the first traf of the moof at offset.
+func moofSamples(data []byte, offset, size int) ([]textSample, error) {
+   moof := data[offset : offset+size]
+   trafs := findBoxes(moof[8:], "traf")
+   if len(trafs) == 0 {
+      return nil, errors.New("box 'traf' not found")
+   }
+   traf := trafs[0].Payload
+   tfhd := findBoxes(traf, "tfhd")
+   if len(tfhd) == 0 || len(tfhd[0].Payload) < 8 {
+      return nil, errors.New("box 'tfhd' not found")
+   }
+   header := tfhd[0].Payload
+   flags := binary.BigEndian.Uint32(header) & 0xffffff
+   base := offset
+   var defaultDuration, defaultSize uint32
+   position := 8
+   field := func() uint32 {
+      if position+4 > len(header) {
+         return 0
+      }
+      value := binary.BigEndian.Uint32(header[position:])
+      position += 4
+      return value
+   }
+   if flags&0x1 != 0 {
+      base = int(uint64(field())<<32 | uint64(field()))
+   }
+   if flags&0x2 != 0 {
+      field()
+   }
+   if flags&0x8 != 0 {
+      defaultDuration = field()
+   }
+   if flags&0x10 != 0 {
+      defaultSize = field()
+   }
+   var decodeTime uint64
+   if tfdt := findBoxes(traf, "tfdt"); len(tfdt) > 0 {
+      var err error
+      decodeTime, err = readTfdt(tfdt[0].Payload)
+      if err != nil {
+         return nil, err
+      }
+   }
+
+   var samples []textSample
+   // without a data offset, samples follow the moof's mdat header
+   dataOffset := offset + size + 8
+   for _, trun := range findBoxes(traf, "trun") {
+      payload := trun.Payload
+      if len(payload) < 8 {
+         return nil, errors.New("truncated trun box")
+      }
+      trunFlags := binary.BigEndian.Uint32(payload) & 0xffffff
+      count := binary.BigEndian.Uint32(payload[4:])
+      cursor := 8
+      if trunFlags&0x1 != 0 {
+         if len(payload) < 12 {
+            return nil, errors.New("truncated trun box")
+         }
+         dataOffset = base + int(int32(binary.BigEndian.Uint32(payload[8:])))
+         cursor += 4
+      }
+      if trunFlags&0x4 != 0 {
+         cursor += 4
+      }
+      for range count {
+         duration, sampleSize := defaultDuration, defaultSize
+         for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+            if trunFlags&bit == 0 {
+               continue
+            }
+            if cursor+4 > len(payload) {
+               return nil, errors.New("truncated trun samples")
+            }
+            value := binary.BigEndian.Uint32(payload[cursor:])
+            cursor += 4
+            switch bit {
+            case 0x100:
+               duration = value
+            case 0x200:
+               sampleSize = value
+            }
+         }
+         if dataOffset < 0 || dataOffset+int(sampleSize) > len(data) {
+            return nil, errors.New("text sample outside segment")
+         }
+         samples = append(samples, textSample{
+            start:    decodeTime,
+            duration: uint64(duration),
+            data:     data[dataOffset : dataOffset+int(sampleSize)],
+         })
+         decodeTime += uint64(duration)
+         dataOffset += int(sampleSize)
+      }
+   }
+   return samples, nil
+}
+
+// subtitle.go
@@ -0,0 +1,203 @@
+package maya
+
+import (
+   "slices"
+   "testing"
+   "time"
+)
+
+func TestParseVttTime(t *testing.T) {
+   tests := map[string]time.Duration{
+      "01:02:03.456": time.Hour + 2*time.Minute + 3456*time.Millisecond,
+      "02:03.456":    2*time.Minute + 3456*time.Millisecond,
+      "00:00:01,500": 1500 * time.Millisecond,
+   }
+   for value, want := range tests {
+      got, err := parseVttTime(value)
+      if err != nil {
+         t.Errorf("%s: %v", value, err)
+      } else if got != want {
+         t.Errorf("%s: %v, want %v", value, got, want)
+      }
+   }
+   for _, value := range []string{"1.5", "a:01.000", "1:2:3:4"} {
+      if _, err := parseVttTime(value); err == nil {
+         t.Errorf("%q: no error", value)
+      }
+   }
+}
+
+func TestParseWebVtt(t *testing.T) {
+   const data = "\xef\xbb\xbfWEBVTT\r\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:01.000\r\n\r\n" +
+      "STYLE\r\n::cue { color: yellow }\r\n\r\n" +
+      "NOTE a comment\r\n\r\n" +
+      "1\r\n00:00:01.000 --> 00:00:02.500 line:0 align:start\r\n<i>Hello</i>\r\nworld\r\n\r\n" +
+      "00:03.000 --> 00:04.000\r\nAgain\r\n"
+   document, err := parseWebVtt([]byte(data))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !document.hasMap || document.mapOffset != 9*time.Second {
+      t.Errorf("map %v %v, want 9s", document.hasMap, document.mapOffset)
+   }
+   if !slices.Equal(document.blocks, []string{"STYLE\n::cue { color: yellow }"}) {
+      t.Errorf("blocks %q", document.blocks)
+   }
+   want := []cue{
+      {start: time.Second, end: 2500 * time.Millisecond, settings: "line:0 align:start", text: "<i>Hello</i>\nworld"},
+      {start: 3 * time.Second, end: 4 * time.Second, text: "Again"},
+   }
+   if !slices.Equal(document.cues, want) {
+      t.Errorf("cues %+v, want %+v", document.cues, want)
+   }
+   if _, err := parseWebVtt([]byte("1\n00:00:01.000 --> 00:00:02.000\nno header\n")); err == nil {
+      t.Error("missing header: no error")
+   }
+}
+
+func TestParseWvttSample(t *testing.T) {
+   sample := appendBox(nil, "vttc",
+      appendBox(nil, "sttg", []byte("line:90%")),
+      appendBox(nil, "payl", []byte("Hello")),
+   )
+   sample = appendBox(sample, "vttc", appendBox(nil, "payl", []byte("World")))
+   cues, err := parseWvttSample(sample, time.Second, 2*time.Second)
+   if err != nil {
+      t.Fatal(err)
+   }
+   want := []cue{
+      {start: time.Second, end: 2 * time.Second, settings: "line:90%", text: "Hello"},
+      {start: time.Second, end: 2 * time.Second, text: "World"},
+   }
+   if !slices.Equal(cues, want) {
+      t.Errorf("cues %+v, want %+v", cues, want)
+   }
+   cues, err = parseWvttSample(appendBox(nil, "vtte"), 0, time.Second)
+   if err != nil || len(cues) != 0 {
+      t.Errorf("vtte: %+v, %v", cues, err)
+   }
+}
+
+func TestSubtitleWriterTiming(t *testing.T) {
+   subtitles := subtitleWriter{
+      format: "vtt",
+      segments: []cueSegment{
+         {start: 0, shift: -4 * time.Second},
+         {start: 10 * time.Second, shift: -4 * time.Second},
+      },
+      from: 5500 * time.Millisecond,
+      to:   7500 * time.Millisecond,
+   }
+   segments := []string{
+      // timed from the stream
+      "WEBVTT\n\n00:00:09.000 --> 00:00:10.000\nFirst\n",
+      // timed from the segment
+      "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nSecond\n\n00:00:08.000 --> 00:00:09.000\nCut\n",
+   }
+   for index, data := range segments {
+      if err := subtitles.WriteSegment(index, []byte(data)); err != nil {
+         t.Fatal(err)
+      }
+   }
+   const want = "WEBVTT\n\n00:00:05.500 --> 00:00:06.000\nFirst\n\n00:00:07.000 --> 00:00:07.500\nSecond\n"
+   if got := string(subtitles.encode("vtt")); got != want {
+      t.Errorf("got %q, want %q", got, want)
+   }
+}
+
+func TestSubtitleWriterTrackTimed(t *testing.T) {
+   tests := []struct {
+      name     string
+      segments []cueSegment
+      data     []string
+      want     string
+   }{
+      {
+         "cue longer ago than the segment",
+         []cueSegment{{start: 60 * time.Second, end: 64 * time.Second}},
+         []string{"WEBVTT\n\n00:00:30.000 --> 00:00:32.000\nEarly\n"},
+         "WEBVTT\n\n00:00:30.000 --> 00:00:32.000\nEarly\n",
+      },
+      {
+         "after a segment timed from the stream",
+         []cueSegment{
+            {start: 10 * time.Second, end: 20 * time.Second},
+            {start: 20 * time.Second, end: 30 * time.Second},
+         },
+         []string{
+            "WEBVTT\n\n00:00:12.000 --> 00:00:13.000\nFirst\n",
+            "WEBVTT\n\n00:00:03.000 --> 00:00:04.000\nEarly\n",
+         },
+         "WEBVTT\n\n00:00:03.000 --> 00:00:04.000\nEarly\n\n00:00:12.000 --> 00:00:13.000\nFirst\n",
+      },
+   }
+   for _, test := range tests {
+      subtitles := subtitleWriter{format: "vtt", segments: test.segments}
+      for index, data := range test.data {
+         if err := subtitles.WriteSegment(index, []byte(data)); err != nil {
+            t.Fatal(err)
+         }
+      }
+      if got := string(subtitles.encode("vtt")); got != test.want {
+         t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+      }
+   }
+}
+
+func TestMergeCues(t *testing.T) {
+   second := func(value float64) time.Duration {
+      return time.Duration(value * float64(time.Second))
+   }
+   tests := []struct {
+      name string
+      cues []cue
+      want []cue
+   }{
+      {
+         "repeated",
+         []cue{{start: second(1), end: second(2), text: "A"}, {start: second(1), end: second(2), text: "A"}},
+         []cue{{start: second(1), end: second(2), text: "A"}},
+      },
+      {
+         "continued",
+         []cue{{start: second(1), end: second(2), text: "A"}, {start: second(2), end: second(3), text: "A"}},
+         []cue{{start: second(1), end: second(3), text: "A"}},
+      },
+      {
+         "continued past another cue",
+         []cue{
+            {start: second(1), end: second(2), text: "A"},
+            {start: second(1.5), end: second(2.5), text: "B"},
+            {start: second(2), end: second(3), text: "A"},
+         },
+         []cue{
+            {start: second(1), end: second(3), text: "A"},
+            {start: second(1.5), end: second(2.5), text: "B"},
+         },
+      },
+      {
+         "repeated later",
+         []cue{{start: second(1), end: second(2), text: "A"}, {start: second(3), end: second(4), text: "A"}},
+         []cue{{start: second(1), end: second(2), text: "A"}, {start: second(3), end: second(4), text: "A"}},
+      },
+      {
+         "other settings",
+         []cue{{start: second(1), end: second(2), text: "A"}, {start: second(1), end: second(2), settings: "line:0", text: "A"}},
+         []cue{{start: second(1), end: second(2), text: "A"}, {start: second(1), end: second(2), settings: "line:0", text: "A"}},
+      },
+      {
+         "overlapping",
+         []cue{{start: second(1), end: second(3), text: "A"}, {start: second(2), end: second(4), text: "A"}},
+         []cue{{start: second(1), end: second(3), text: "A"}, {start: second(2), end: second(4), text: "A"}},
+      },
+   }
+   for _, test := range tests {
+      subtitles := subtitleWriter{cues: test.cues}
+      subtitles.mergeCues()
+      if !slices.Equal(subtitles.cues, test.want) {
+         t.Errorf("%s: %+v, want %+v", test.name, subtitles.cues, test.want)
+      }
+   }
+}
+
+// subtitle_test.go
@@ -0,0 +1,366 @@
+package maya
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "math"
+   "strings"
+)
+
+// timeline rewrites the decode times of fragments so that segments from
+// several sources, such as DASH periods, play as one continuous track
+// starting at zero. Each track ID keeps its own base, so the tracks of one
+// fragment stay apart.
+type timeline struct {
+   // offset is the time of the first segment, in seconds, which becomes
+   // zero
+   offset float64
+   tracks map[uint32]*trackLine
+}
+
+// trackLine is the state of one track of a timeline.
+type trackLine struct {
+   // timescale of the output track, taken from the first source
+   timescale uint32
+   source    int
+   hasBase   bool
+   // base is the decode time of the current source that plays at start
+   base  uint64
+   start float64
+}
+
+// trackTiming is the timescale and trex default sample duration of a
+// track, read from its init segment.
+type trackTiming struct {
+   timescale       uint32
+   defaultDuration uint32
+}
+
+// parseTrackTiming reads the timing of the first track of an init segment.
+func parseTrackTiming(initData []byte) (*trackTiming, error) {
+   traks := findBoxes(initData, "moov", "trak")
+   if len(traks) == 0 {
+      return nil, errors.New("box 'trak' not found")
+   }
+   _, timing, err := readTrackTiming(traks[0].Payload, findBoxes(initData, "moov", "mvex", "trex"))
+   return timing, err
+}
+
+// parseTrackTimings reads the timing of every track of an init segment, by
+// track ID.
+func parseTrackTimings(initData []byte) (map[uint32]*trackTiming, error) {
+   trex := findBoxes(initData, "moov", "mvex", "trex")
+   timings := make(map[uint32]*trackTiming)
+   for _, trak := range findBoxes(initData, "moov", "trak") {
+      trackId, timing, err := readTrackTiming(trak.Payload, trex)
+      if err != nil {
+         return nil, err
+      }
+      timings[trackId] = timing
+   }
+   if len(timings) == 0 {
+      return nil, errors.New("box 'trak' not found")
+   }
+   return timings, nil
+}
+
+// readTrackTiming reads the track ID and timing of a trak box, with the
+// default duration of the matching trex box.
+func readTrackTiming(trak []byte, trex []mp4Box) (uint32, *trackTiming, error) {
+   trackId, err := readTrackId(trak)
+   if err != nil {
+      return 0, nil, err
+   }
+   var timing trackTiming
+   mdhd := findBoxes(trak, "mdia", "mdhd")
+   if len(mdhd) == 0 {
+      return 0, nil, errors.New("box 'mdhd' not found")
+   }
+   payload := mdhd[0].Payload
+   offset := 12
+   if len(payload) > 0 && payload[0] == 1 {
+      offset = 20
+   }
+   if len(payload) < offset+4 {
+      return 0, nil, errors.New("truncated mdhd box")
+   }
+   timing.timescale = binary.BigEndian.Uint32(payload[offset:])
+   if timing.timescale == 0 {
+      return 0, nil, errors.New("mdhd timescale is zero")
+   }
+   for _, box := range trex {
+      if len(box.Payload) < 16 {
+         return 0, nil, errors.New("truncated trex box")
+      }
+      if binary.BigEndian.Uint32(box.Payload[4:]) == trackId {
+         timing.defaultDuration = binary.BigEndian.Uint32(box.Payload[12:])
+      }
+   }
+   return trackId, &timing, nil
+}
+
+// readTrackId reads the track ID from the tkhd box of a trak.
+func readTrackId(trak []byte) (uint32, error) {
+   tkhd := findBoxes(trak, "tkhd")
+   if len(tkhd) == 0 {
+      return 0, errors.New("box 'tkhd' not found")
+   }
+   offset := 12
+   if len(tkhd[0].Payload) > 0 && tkhd[0].Payload[0] == 1 {
+      offset = 20
+   }
+   if len(tkhd[0].Payload) < offset+4 {
+      return 0, errors.New("truncated tkhd box")
+   }
+   return binary.BigEndian.Uint32(tkhd[0].Payload[offset:]), nil
+}
+
+// rebase rewrites, in place, the decode times of the fragments in a segment
+// of period. An anchored period begins at its presentation offset; any
+// other starts at the decode time of its first segment. Sample durations are
+// rescaled if the period timescale differs from the output.
+func (t *timeline) rebase(data []byte, seg *segment, period *sourcePeriod, timings map[uint32]*trackTiming) error {
+   for _, traf := range findBoxes(data, "moof", "traf") {
+      tfhd := findBoxes(traf.Payload, "tfhd")
+      if len(tfhd) == 0 || len(tfhd[0].Payload) < 8 {
+         return errors.New("box 'tfhd' not found")
+      }
+      trackId := binary.BigEndian.Uint32(tfhd[0].Payload[4:])
+      timing, ok := timings[trackId]
+      if !ok {
+         return fmt.Errorf("track %d is not in the init segment", trackId)
+      }
+      tfdt := findBoxes(traf.Payload, "tfdt")
+      if len(tfdt) == 0 {
+         return errors.New("box 'tfdt' not found")
+      }
+      decodeTime, err := readTfdt(tfdt[0].Payload)
+      if err != nil {
+         return err
+      }
+      line := t.tracks[trackId]
+      if line == nil {
+         if t.tracks == nil {
+            t.tracks = make(map[uint32]*trackLine)
+         }
+         line = &trackLine{timescale: timing.timescale}
+         t.tracks[trackId] = line
+      }
+      if !line.hasBase || line.source != seg.period {
+         line.source, line.hasBase = seg.period, true
+         if period.anchored {
+            line.base = uint64(math.Round(period.presentationOffset * float64(timing.timescale)))
+            line.start = period.start
+         } else {
+            line.base, line.start = decodeTime, seg.time
+         }
+      }
+      newTime := int64(math.Round((line.start - t.offset) * float64(line.timescale)))
+      newTime += (int64(decodeTime) - int64(line.base)) * int64(line.timescale) / int64(timing.timescale)
+      if err := writeTfdt(tfdt[0].Payload, uint64(max(newTime, 0))); err != nil {
+         return err
+      }
+      if err := line.rescaleDurations(traf.Payload, timing); err != nil {
+         return err
+      }
+   }
+   return nil
+}
+
+// scale converts a duration from the source timescale to the output.
+func (t *trackLine) scale(value uint64, timescale uint32) uint64 {
+   if timescale == t.timescale {
+      return value
+   }
+   return value * uint64(t.timescale) / uint64(timescale)
+}
+
+// rescaleDurations converts the sample durations and composition offsets
+// of a track fragment to the output timescale in place. Samples timed by the
+// trex default duration cannot be rescaled, as the default is in the init
+// segment.
+func (t *trackLine) rescaleDurations(traf []byte, timing *trackTiming) error {
+   if timing.timescale == t.timescale {
+      return nil
+   }
+   tfhd := findBoxes(traf, "tfhd")
+   if len(tfhd) == 0 {
+      return errors.New("box 'tfhd' not found")
+   }
+   defaultField := tfhdDurationField(tfhd[0].Payload)
+   if defaultField != nil {
+      duration := binary.BigEndian.Uint32(defaultField)
+      binary.BigEndian.PutUint32(defaultField, uint32(t.scale(uint64(duration), timing.timescale)))
+   }
+   for _, trun := range findBoxes(traf, "trun") {
+      payload := trun.Payload
+      if len(payload) < 8 {
+         return errors.New("truncated trun box")
+      }
+      flags := binary.BigEndian.Uint32(payload) & 0xffffff
+      sampleCount := binary.BigEndian.Uint32(payload[4:])
+      if flags&0x100 == 0 && defaultField == nil && sampleCount > 0 {
+         return fmt.Errorf("cannot rescale trex default duration from timescale %d to %d", timing.timescale, t.timescale)
+      }
+      if flags&0x900 == 0 {
+         continue
+      }
+      offset := 8
+      if flags&0x1 != 0 {
+         offset += 4
+      }
+      if flags&0x4 != 0 {
+         offset += 4
+      }
+      var sampleSize int
+      for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+         if flags&bit != 0 {
+            sampleSize += 4
+         }
+      }
+      if uint64(len(payload)) < uint64(offset)+uint64(sampleCount)*uint64(sampleSize) {
+         return errors.New("truncated trun samples")
+      }
+      for range sampleCount {
+         field := payload[offset:]
+         if flags&0x100 != 0 {
+            duration := binary.BigEndian.Uint32(field)
+            binary.BigEndian.PutUint32(field, uint32(t.scale(uint64(duration), timing.timescale)))
+         }
+         if flags&0x800 != 0 {
+            // signed in version 1, and small enough to read as signed in 0
+            field = payload[offset+sampleSize-4:]
+            composition := int64(int32(binary.BigEndian.Uint32(field)))
+            composition = composition * int64(t.timescale) / int64(timing.timescale)
+            binary.BigEndian.PutUint32(field, uint32(int32(composition)))
+         }
+         offset += sampleSize
+      }
+   }
+   return nil
+}
+
+// sampleEntries describes the sample entries of every track of an init
+// segment, with encryption undone: the original format from frma replaces
+// encv or enca, and the sinf box is left out. Periods whose descriptions
+// differ cannot share one init segment.
+func sampleEntries(initData []byte) ([]string, error) {
+   var entries []string
+   for _, trak := range findBoxes(initData, "moov", "trak") {
+      var handler string
+      if hdlr := findBoxes(trak.Payload, "mdia", "hdlr"); len(hdlr) > 0 && len(hdlr[0].Payload) >= 12 {
+         handler = string(hdlr[0].Payload[8:12])
+      }
+      for _, stsd := range findBoxes(trak.Payload, "mdia", "minf", "stbl", "stsd") {
+         if len(stsd.Payload) < 8 {
+            return nil, errors.New("truncated stsd box")
+         }
+         boxes, err := readBoxes(stsd.Payload[8:])
+         if err != nil {
+            return nil, fmt.Errorf("stsd box: %w", err)
+         }
+         for _, entry := range boxes {
+            description, err := describeSampleEntry(entry, handler)
+            if err != nil {
+               return nil, err
+            }
+            entries = append(entries, description)
+         }
+      }
+   }
+   return entries, nil
+}
+
+// describeSampleEntry returns the format, fields and child boxes of one
+// sample entry, without its sinf box.
+func describeSampleEntry(entry mp4Box, handler string) (string, error) {
+   // the fields before the child boxes of visual and audio sample entries
+   var header int
+   switch handler {
+   case "vide":
+      header = 78
+   case "soun":
+      header = 28
+      if len(entry.Payload) >= 10 {
+         switch binary.BigEndian.Uint16(entry.Payload[8:]) {
+         case 1:
+            header += 16
+         case 2:
+            header += 36
+         }
+      }
+   default:
+      return entry.Type + string(entry.Payload), nil
+   }
+   if len(entry.Payload) < header {
+      return "", fmt.Errorf("truncated %v sample entry", entry.Type)
+   }
+   children, err := readBoxes(entry.Payload[header:])
+   if err != nil {
+      return "", fmt.Errorf("%v sample entry: %w", entry.Type, err)
+   }
+   format := entry.Type
+   var b strings.Builder
+   b.Write(entry.Payload[:header])
+   for _, child := range children {
+      if child.Type == "sinf" {
+         if frma := findBoxes(child.Payload, "frma"); len(frma) > 0 && len(frma[0].Payload) >= 4 {
+            format = string(frma[0].Payload[:4])
+         }
+         continue
+      }
+      b.WriteString(child.Type)
+      b.Write(child.Payload)
+   }
+   return format + b.String(), nil
+}
+
+// tfhdDurationField returns the default_sample_duration field of a tfhd
+// payload, or nil if it is absent.
+func tfhdDurationField(tfhd []byte) []byte {
+   if len(tfhd) < 8 {
+      return nil
+   }
+   flags := binary.BigEndian.Uint32(tfhd) & 0xffffff
+   if flags&0x8 == 0 {
+      return nil
+   }
+   offset := 8
+   if flags&0x1 != 0 {
+      offset += 8
+   }
+   if flags&0x2 != 0 {
+      offset += 4
+   }
+   if len(tfhd) < offset+4 {
+      return nil
+   }
+   return tfhd[offset : offset+4]
+}
+
+// readTfdt returns the baseMediaDecodeTime of a tfdt payload.
+func readTfdt(tfdt []byte) (uint64, error) {
+   if len(tfdt) >= 12 && tfdt[0] == 1 {
+      return binary.BigEndian.Uint64(tfdt[4:]), nil
+   }
+   if len(tfdt) >= 8 {
+      return uint64(binary.BigEndian.Uint32(tfdt[4:])), nil
+   }
+   return 0, errors.New("truncated tfdt box")
+}
+
+// writeTfdt sets the baseMediaDecodeTime of a tfdt payload in place.
+func writeTfdt(tfdt []byte, value uint64) error {
+   if tfdt[0] == 1 {
+      binary.BigEndian.PutUint64(tfdt[4:], value)
+      return nil
+   }
+   if value > 0xffffffff {
+      return fmt.Errorf("decode time %d does not fit a version 0 tfdt", value)
+   }
+   binary.BigEndian.PutUint32(tfdt[4:], uint32(value))
+   return nil
+}
+
+// timeline.go
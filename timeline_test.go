@@ -0,0 +1,41 @@
+package maya
+
+import (
+   "encoding/binary"
+   "testing"
+)
+
+// trunBox builds a trun box of version 1 with the given flags and 32-bit
+// sample fields.
+func trunBox(flags uint32, count uint32, fields ...uint32) []byte {
+   payload := binary.BigEndian.AppendUint32(nil, 1<<24|flags)
+   payload = binary.BigEndian.AppendUint32(payload, count)
+   for _, field := range fields {
+      payload = binary.BigEndian.AppendUint32(payload, field)
+   }
+   return appendBox(nil, "trun", payload)
+}
+
+func TestRescaleDurations(t *testing.T) {
+   tfhd := appendBox(nil, "tfhd", []byte{0, 0, 0, 0, 0, 0, 0, 1})
+   negative := -3000
+   traf := append(tfhd, trunBox(0x900, 2, 3000, 6000, 3000, uint32(negative))...)
+   line := trackLine{timescale: 1000}
+   if err := line.rescaleDurations(traf, &trackTiming{timescale: 90000}); err != nil {
+      t.Fatal(err)
+   }
+   samples := findBoxes(traf, "trun")[0].Payload[8:]
+   want := []int32{33, 66, 33, -33}
+   for index, value := range want {
+      if got := int32(binary.BigEndian.Uint32(samples[index*4:])); got != value {
+         t.Errorf("field %d = %d, want %d", index, got, value)
+      }
+   }
+   // samples timed by the trex default cannot be rescaled
+   traf = append(tfhd, trunBox(0, 1)...)
+   if err := line.rescaleDurations(traf, &trackTiming{timescale: 90000}); err == nil {
+      t.Error("trex default duration: no error")
+   }
+}
+
+// timeline_test.go
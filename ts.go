@@ -0,0 +1,227 @@
+package maya
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "log"
+)
+
+const tsPacketSize = 188
+
+// MPEG-TS stream types that can be remuxed to MP4.
+const (
+   tsStreamAac  = 0x0f
+   tsStreamH264 = 0x1b
+   tsStreamHevc = 0x24
+   tsStreamAc3  = 0x81
+)
+
+// pesPacket is one reassembled PES packet. Timestamps are in 90 kHz units.
+type pesPacket struct {
+   pts, dts uint64
+   hasPts   bool
+   data     []byte
+}
+
+// tsDemuxer reassembles the PES packets of the elementary streams of a
+// transport stream, as listed by its first program map table.
+type tsDemuxer struct {
+   pmtPid int
+   // streamTypes maps PIDs to stream types, in the order of the PMT.
+   streamTypes map[int]byte
+   pids        []int
+   pes         map[int][]byte
+   skipped     map[byte]bool
+}
+
+// demux calls emit for every complete PES packet in data. Packets still
+// open at the end of data are emitted too, since HLS segments start on
+// packet boundaries.
+func (d *tsDemuxer) demux(data []byte, emit func(pid int, pes *pesPacket) error) error {
+   if d.pes == nil {
+      d.pes = make(map[int][]byte)
+   }
+   for offset := 0; offset+tsPacketSize <= len(data); offset += tsPacketSize {
+      packet := data[offset : offset+tsPacketSize]
+      if packet[0] != 0x47 {
+         return fmt.Errorf("lost TS sync at offset %d", offset)
+      }
+      start := packet[1]&0x40 != 0
+      pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+      control := packet[3] >> 4 & 3
+      payload := packet[4:]
+      if control&2 != 0 {
+         size := int(payload[0])
+         if 1+size > len(payload) {
+            return fmt.Errorf("invalid adaptation field at offset %d", offset)
+         }
+         payload = payload[1+size:]
+      }
+      if control&1 == 0 {
+         continue
+      }
+      switch {
+      case pid == 0:
+         if start {
+            if err := d.parsePat(payload); err != nil {
+               return err
+            }
+         }
+      case d.pmtPid != 0 && pid == d.pmtPid:
+         if start && d.streamTypes == nil {
+            if err := d.parsePmt(payload); err != nil {
+               return err
+            }
+         }
+      default:
+         if _, ok := d.streamTypes[pid]; !ok {
+            continue
+         }
+         if start {
+            if err := d.flush(pid, emit); err != nil {
+               return err
+            }
+            d.pes[pid] = append([]byte{}, payload...)
+         } else if d.pes[pid] != nil {
+            d.pes[pid] = append(d.pes[pid], payload...)
+         }
+      }
+   }
+   for _, pid := range d.pids {
+      if err := d.flush(pid, emit); err != nil {
+         return err
+      }
+   }
+   return nil
+}
+
+// flush emits the PES packet being assembled for pid, if any.
+func (d *tsDemuxer) flush(pid int, emit func(pid int, pes *pesPacket) error) error {
+   data := d.pes[pid]
+   if data == nil {
+      return nil
+   }
+   delete(d.pes, pid)
+   pes, err := parsePes(data)
+   if err != nil {
+      return fmt.Errorf("PID %d: %w", pid, err)
+   }
+   return emit(pid, pes)
+}
+
+// psiSection returns the section of a PSI packet payload, without its CRC.
+func psiSection(payload []byte) ([]byte, error) {
+   if len(payload) < 1 || 1+int(payload[0])+3 > len(payload) {
+      return nil, errors.New("truncated PSI section")
+   }
+   section := payload[1+int(payload[0]):]
+   size := int(binary.BigEndian.Uint16(section[1:]) & 0xfff)
+   if size < 9 || 3+size > len(section) {
+      return nil, errors.New("truncated PSI section")
+   }
+   return section[:3+size-4], nil
+}
+
+func (d *tsDemuxer) parsePat(payload []byte) error {
+   section, err := psiSection(payload)
+   if err != nil {
+      return fmt.Errorf("PAT: %w", err)
+   }
+   for entry := section[8:]; len(entry) >= 4; entry = entry[4:] {
+      program := binary.BigEndian.Uint16(entry)
+      if program != 0 {
+         d.pmtPid = int(binary.BigEndian.Uint16(entry[2:]) & 0x1fff)
+         return nil
+      }
+   }
+   return errors.New("PAT lists no program")
+}
+
+func (d *tsDemuxer) parsePmt(payload []byte) error {
+   section, err := psiSection(payload)
+   if err != nil {
+      return fmt.Errorf("PMT: %w", err)
+   }
+   if len(section) < 12 {
+      return errors.New("PMT: truncated header")
+   }
+   infoSize := int(binary.BigEndian.Uint16(section[10:]) & 0xfff)
+   if 12+infoSize > len(section) {
+      return errors.New("PMT: truncated program info")
+   }
+   d.streamTypes = make(map[int]byte)
+   for entry := section[12+infoSize:]; len(entry) >= 5; {
+      streamType := entry[0]
+      pid := int(binary.BigEndian.Uint16(entry[1:]) & 0x1fff)
+      size := int(binary.BigEndian.Uint16(entry[3:]) & 0xfff)
+      if 5+size > len(entry) {
+         return errors.New("PMT: truncated stream info")
+      }
+      if streamType == 0x06 && hasAc3Descriptor(entry[5:5+size]) {
+         streamType = tsStreamAc3
+      }
+      switch streamType {
+      case tsStreamAac, tsStreamH264, tsStreamHevc, tsStreamAc3:
+         d.streamTypes[pid] = streamType
+         d.pids = append(d.pids, pid)
+      default:
+         if !d.skipped[streamType] {
+            if d.skipped == nil {
+               d.skipped = make(map[byte]bool)
+            }
+            d.skipped[streamType] = true
+            log.Printf("skip TS stream type 0x%02x", streamType)
+         }
+      }
+      entry = entry[5+size:]
+   }
+   return nil
+}
+
+// hasAc3Descriptor reports whether PMT stream descriptors mark a private
+// stream as AC-3, by an AC-3 descriptor or an "AC-3" registration.
+func hasAc3Descriptor(descriptors []byte) bool {
+   for len(descriptors) >= 2 {
+      tag, size := descriptors[0], int(descriptors[1])
+      if 2+size > len(descriptors) {
+         return false
+      }
+      if tag == 0x6a || tag == 0x05 && string(descriptors[2:2+size]) == "AC-3" {
+         return true
+      }
+      descriptors = descriptors[2+size:]
+   }
+   return false
+}
+
+func parsePes(data []byte) (*pesPacket, error) {
+   if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+      return nil, errors.New("invalid PES start code")
+   }
+   if size := int(binary.BigEndian.Uint16(data[4:])); size > 0 && 6+size <= len(data) {
+      data = data[:6+size]
+   }
+   flags := data[7]
+   headerSize := int(data[8])
+   if 9+headerSize > len(data) {
+      return nil, errors.New("truncated PES header")
+   }
+   pes := &pesPacket{data: data[9+headerSize:]}
+   if flags&0x80 != 0 && headerSize >= 5 {
+      pes.pts = readPesTimestamp(data[9:])
+      pes.dts = pes.pts
+      pes.hasPts = true
+   }
+   if flags&0x40 != 0 && headerSize >= 10 {
+      pes.dts = readPesTimestamp(data[14:])
+   }
+   return pes, nil
+}
+
+func readPesTimestamp(data []byte) uint64 {
+   return uint64(data[0]>>1&7)<<30 | uint64(data[1])<<22 | uint64(data[2]>>1)<<15 |
+      uint64(data[3])<<7 | uint64(data[4]>>1)
+}
+
+// ts.go
@@ -0,0 +1,406 @@
+package maya
+
+import (
+   "bytes"
+   "encoding/binary"
+   "errors"
+   "fmt"
+)
+
+// splitAnnexB returns the NAL units of an Annex B byte stream.
+func splitAnnexB(data []byte) [][]byte {
+   var units [][]byte
+   start := -1
+   for index := 0; index+2 < len(data); index++ {
+      if data[index] != 0 || data[index+1] != 0 || data[index+2] != 1 {
+         continue
+      }
+      if start >= 0 {
+         units = append(units, bytes.TrimRight(data[start:index], "\x00"))
+      }
+      index += 2
+      start = index + 1
+   }
+   if start >= 0 && start < len(data) {
+      units = append(units, data[start:])
+   }
+   return units
+}
+
+// unescapeRbsp removes the emulation prevention bytes of a NAL unit.
+func unescapeRbsp(data []byte) []byte {
+   rbsp := make([]byte, 0, len(data))
+   var zeros int
+   for _, b := range data {
+      if zeros >= 2 && b == 3 {
+         zeros = 0
+         continue
+      }
+      if b == 0 {
+         zeros++
+      } else {
+         zeros = 0
+      }
+      rbsp = append(rbsp, b)
+   }
+   return rbsp
+}
+
+// bitReader reads the bit fields and Exp-Golomb codes of parameter sets.
+type bitReader struct {
+   data []byte
+   bit  int
+   err  error
+}
+
+func (b *bitReader) u(count int) uint32 {
+   var value uint32
+   for range count {
+      if b.bit >= len(b.data)*8 {
+         b.err = errors.New("truncated parameter set")
+         return 0
+      }
+      value = value<<1 | uint32(b.data[b.bit/8]>>(7-b.bit%8)&1)
+      b.bit++
+   }
+   return value
+}
+
+func (b *bitReader) ue() uint32 {
+   var zeros int
+   for b.u(1) == 0 {
+      if b.err != nil || zeros > 31 {
+         b.err = errors.New("invalid Exp-Golomb code")
+         return 0
+      }
+      zeros++
+   }
+   return 1<<zeros - 1 + b.u(zeros)
+}
+
+func (b *bitReader) se() int32 {
+   value := b.ue()
+   if value&1 != 0 {
+      return int32(value/2 + 1)
+   }
+   return -int32(value / 2)
+}
+
+// videoSize is the display size decoded from a sequence parameter set.
+type videoSize struct {
+   width, height uint16
+}
+
+// parseAvcSps reads the picture size of an H.264 sequence parameter set.
+func parseAvcSps(sps []byte) (*videoSize, error) {
+   b := bitReader{data: unescapeRbsp(sps[1:])}
+   profile := b.u(8)
+   b.u(16) // constraint flags and level
+   b.ue()  // seq_parameter_set_id
+   chromaFormat := uint32(1)
+   switch profile {
+   case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+      chromaFormat = b.ue()
+      if chromaFormat == 3 {
+         b.u(1) // separate_colour_plane_flag
+      }
+      b.ue() // bit_depth_luma_minus8
+      b.ue() // bit_depth_chroma_minus8
+      b.u(1) // qpprime_y_zero_transform_bypass_flag
+      if b.u(1) != 0 {
+         lists := 8
+         if chromaFormat == 3 {
+            lists = 12
+         }
+         for index := range lists {
+            if b.u(1) == 0 {
+               continue
+            }
+            size := 16
+            if index >= 6 {
+               size = 64
+            }
+            last, next := int32(8), int32(8)
+            for range size {
+               if next != 0 {
+                  next = (last + b.se() + 256) % 256
+               }
+               if next != 0 {
+                  last = next
+               }
+            }
+         }
+      }
+   }
+   b.ue() // log2_max_frame_num_minus4
+   switch b.ue() {
+   case 0:
+      b.ue() // log2_max_pic_order_cnt_lsb_minus4
+   case 1:
+      b.u(1)
+      b.se()
+      b.se()
+      for range b.ue() {
+         b.se()
+      }
+   }
+   b.ue() // max_num_ref_frames
+   b.u(1) // gaps_in_frame_num_value_allowed_flag
+   widthMbs := b.ue() + 1
+   heightUnits := b.ue() + 1
+   frameMbsOnly := b.u(1)
+   if frameMbsOnly == 0 {
+      b.u(1) // mb_adaptive_frame_field_flag
+   }
+   b.u(1) // direct_8x8_inference_flag
+   var left, right, top, bottom uint32
+   if b.u(1) != 0 {
+      left, right, top, bottom = b.ue(), b.ue(), b.ue(), b.ue()
+   }
+   if b.err != nil {
+      return nil, fmt.Errorf("H.264 SPS: %w", b.err)
+   }
+   cropX, cropY := uint32(1), 2-frameMbsOnly
+   switch chromaFormat {
+   case 1:
+      cropX, cropY = 2, 2*(2-frameMbsOnly)
+   case 2:
+      cropX = 2
+   }
+   return &videoSize{
+      width:  uint16(widthMbs*16 - (left+right)*cropX),
+      height: uint16((2-frameMbsOnly)*heightUnits*16 - (top+bottom)*cropY),
+   }, nil
+}
+
+// avcConfig builds an avcC box from the first SPS and PPS of a stream.
+func avcConfig(sps, pps []byte) []byte {
+   payload := []byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}
+   payload = binary.BigEndian.AppendUint16(payload, uint16(len(sps)))
+   payload = append(payload, sps...)
+   payload = append(payload, 1)
+   payload = binary.BigEndian.AppendUint16(payload, uint16(len(pps)))
+   payload = append(payload, pps...)
+   return appendBox(nil, "avcC", payload)
+}
+
+// hevcSps holds the fields of an HEVC sequence parameter set needed for
+// the hvcC box.
+type hevcSps struct {
+   videoSize
+   profileTierLevel [12]byte
+   subLayers        uint32
+   temporalNesting  uint32
+   chromaFormat     uint32
+   bitDepthLuma     uint32
+   bitDepthChroma   uint32
+}
+
+// parseHevcSps reads an HEVC sequence parameter set, NAL header included.
+func parseHevcSps(sps []byte) (*hevcSps, error) {
+   b := bitReader{data: unescapeRbsp(sps[2:])}
+   var info hevcSps
+   b.u(4) // sps_video_parameter_set_id
+   maxSubLayers := b.u(3)
+   info.subLayers = maxSubLayers + 1
+   info.temporalNesting = b.u(1)
+   for index := range info.profileTierLevel {
+      info.profileTierLevel[index] = byte(b.u(8))
+   }
+   var profilePresent, levelPresent [8]bool
+   for index := range maxSubLayers {
+      profilePresent[index] = b.u(1) != 0
+      levelPresent[index] = b.u(1) != 0
+   }
+   if maxSubLayers > 0 {
+      for range 8 - maxSubLayers {
+         b.u(2)
+      }
+   }
+   for index := range maxSubLayers {
+      if profilePresent[index] {
+         b.u(32)
+         b.u(32)
+         b.u(24)
+      }
+      if levelPresent[index] {
+         b.u(8)
+      }
+   }
+   b.ue() // sps_seq_parameter_set_id
+   info.chromaFormat = b.ue()
+   if info.chromaFormat == 3 {
+      b.u(1) // separate_colour_plane_flag
+   }
+   width, height := b.ue(), b.ue()
+   if b.u(1) != 0 {
+      left, right, top, bottom := b.ue(), b.ue(), b.ue(), b.ue()
+      cropX, cropY := uint32(1), uint32(1)
+      switch info.chromaFormat {
+      case 1:
+         cropX, cropY = 2, 2
+      case 2:
+         cropX = 2
+      }
+      width -= (left + right) * cropX
+      height -= (top + bottom) * cropY
+   }
+   info.bitDepthLuma = b.ue()
+   info.bitDepthChroma = b.ue()
+   if b.err != nil {
+      return nil, fmt.Errorf("HEVC SPS: %w", b.err)
+   }
+   info.width, info.height = uint16(width), uint16(height)
+   return &info, nil
+}
+
+// hevcConfig builds an hvcC box from the VPS, SPS and PPS of a stream.
+func hevcConfig(info *hevcSps, vps, sps, pps []byte) []byte {
+   payload := []byte{1}
+   payload = append(payload, info.profileTierLevel[:]...)
+   payload = append(payload,
+      0xf0, 0x00, // min_spatial_segmentation_idc
+      0xfc, // parallelismType
+      0xfc|byte(info.chromaFormat),
+      0xf8|byte(info.bitDepthLuma),
+      0xf8|byte(info.bitDepthChroma),
+      0, 0, // avgFrameRate
+      byte(info.subLayers&7)<<3|byte(info.temporalNesting)<<2|3,
+      3,
+   )
+   for _, unit := range [][]byte{vps, sps, pps} {
+      payload = append(payload, 0x80|unit[0]>>1&0x3f, 0, 1)
+      payload = binary.BigEndian.AppendUint16(payload, uint16(len(unit)))
+      payload = append(payload, unit...)
+   }
+   return appendBox(nil, "hvcC", payload)
+}
+
+// errTruncatedFrame means an audio frame continues in the next PES packet.
+var errTruncatedFrame = errors.New("truncated audio frame")
+
+var adtsSampleRates = [...]uint32{
+   96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// adtsFrame is one AAC frame of an ADTS stream.
+type adtsFrame struct {
+   sampleRate uint32
+   channels   uint16
+   // config is the AudioSpecificConfig of the frame.
+   config []byte
+   data   []byte
+   size   int
+}
+
+// parseAdts reads the ADTS frame at the start of data.
+func parseAdts(data []byte) (*adtsFrame, error) {
+   if len(data) < 7 {
+      return nil, errTruncatedFrame
+   }
+   if data[0] != 0xff || data[1]&0xf6 != 0xf0 {
+      return nil, errors.New("invalid ADTS header")
+   }
+   profile := data[2] >> 6
+   rateIndex := data[2] >> 2 & 0xf
+   channels := data[2]&1<<2 | data[3]>>6
+   size := int(data[3]&3)<<11 | int(data[4])<<3 | int(data[5]>>5)
+   headerSize := 7
+   if data[1]&1 == 0 {
+      headerSize = 9
+   }
+   if int(rateIndex) >= len(adtsSampleRates) {
+      return nil, fmt.Errorf("invalid ADTS sample rate index %d", rateIndex)
+   }
+   if size < headerSize {
+      return nil, errors.New("invalid ADTS frame size")
+   }
+   if size > len(data) {
+      return nil, errTruncatedFrame
+   }
+   objectType := profile + 1
+   return &adtsFrame{
+      sampleRate: adtsSampleRates[rateIndex],
+      channels:   uint16(channels),
+      config:     []byte{objectType<<3 | rateIndex>>1, rateIndex&1<<7 | channels<<3},
+      data:       data[headerSize:size],
+      size:       size,
+   }, nil
+}
+
+// esdsBox builds the esds box of an AAC sample entry.
+func esdsBox(config []byte) []byte {
+   decoderSpecific := append([]byte{0x05, byte(len(config))}, config...)
+   decoderConfig := []byte{0x04, byte(13 + len(decoderSpecific)), 0x40, 0x15, 0, 0, 0}
+   decoderConfig = append(decoderConfig, make([]byte, 8)...)
+   decoderConfig = append(decoderConfig, decoderSpecific...)
+   descriptor := []byte{0x03, byte(3 + len(decoderConfig) + 3), 0, 0, 0}
+   descriptor = append(descriptor, decoderConfig...)
+   descriptor = append(descriptor, 0x06, 1, 0x02)
+   return appendBox(nil, "esds", fullBoxHeader(0, 0), descriptor)
+}
+
+var ac3SampleRates = [...]uint32{48000, 44100, 32000}
+
+// ac3FrameWords is the size of an AC-3 frame in 16-bit words, by sample
+// rate code and frame size code.
+var ac3FrameWords = [3][38]uint16{
+   {64, 64, 80, 80, 96, 96, 112, 112, 128, 128, 160, 160, 192, 192, 224, 224, 256, 256, 320, 320,
+      384, 384, 448, 448, 512, 512, 640, 640, 768, 768, 896, 896, 1024, 1024, 1152, 1152, 1280, 1280},
+   {69, 70, 87, 88, 104, 105, 121, 122, 139, 140, 174, 175, 208, 209, 243, 244, 278, 279, 348, 349,
+      417, 418, 487, 488, 557, 558, 696, 697, 835, 836, 975, 976, 1114, 1115, 1253, 1254, 1393, 1394},
+   {96, 96, 120, 120, 144, 144, 168, 168, 192, 192, 240, 240, 288, 288, 336, 336, 384, 384, 480, 480,
+      576, 576, 672, 672, 768, 768, 960, 960, 1152, 1152, 1344, 1344, 1536, 1536, 1728, 1728, 1920, 1920},
+}
+
+// ac3Frame is one AC-3 sync frame.
+type ac3Frame struct {
+   sampleRate uint32
+   channels   uint16
+   // config is the payload of the dac3 box.
+   config []byte
+   data   []byte
+}
+
+// parseAc3 reads the AC-3 sync frame at the start of data.
+func parseAc3(data []byte) (*ac3Frame, error) {
+   if len(data) < 7 {
+      return nil, errTruncatedFrame
+   }
+   if data[0] != 0x0b || data[1] != 0x77 {
+      return nil, errors.New("invalid AC-3 sync word")
+   }
+   rateCode := data[4] >> 6
+   sizeCode := data[4] & 0x3f
+   if rateCode > 2 || sizeCode > 37 {
+      return nil, fmt.Errorf("invalid AC-3 rate code %d or size code %d", rateCode, sizeCode)
+   }
+   size := int(ac3FrameWords[rateCode][sizeCode]) * 2
+   if size > len(data) {
+      return nil, errTruncatedFrame
+   }
+   b := bitReader{data: data[5:]}
+   bsid := b.u(5)
+   bsmod := b.u(3)
+   acmod := b.u(3)
+   if acmod&1 != 0 && acmod != 1 {
+      b.u(2) // cmixlev
+   }
+   if acmod&4 != 0 {
+      b.u(2) // surmixlev
+   }
+   if acmod == 2 {
+      b.u(2) // dsurmod
+   }
+   lfe := b.u(1)
+   config := uint32(rateCode)<<22 | bsid<<17 | bsmod<<14 | acmod<<11 | lfe<<10 | uint32(sizeCode>>1)<<5
+   channels := [...]uint16{2, 1, 2, 3, 3, 4, 4, 5}[acmod] + uint16(lfe)
+   return &ac3Frame{
+      sampleRate: ac3SampleRates[rateCode],
+      channels:   channels,
+      config:     []byte{byte(config >> 16), byte(config >> 8), byte(config)},
+      data:       data[:size],
+   }, nil
+}
+
+// ts_codec.go
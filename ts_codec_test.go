@@ -0,0 +1,155 @@
+package maya
+
+import (
+   "bytes"
+   "errors"
+   "slices"
+   "testing"
+)
+
+// bitWriter writes the bit fields and Exp-Golomb codes read by bitReader.
+type bitWriter struct {
+   data []byte
+   bit  int
+}
+
+func (b *bitWriter) u(count int, value uint32) {
+   for index := count - 1; index >= 0; index-- {
+      if b.bit%8 == 0 {
+         b.data = append(b.data, 0)
+      }
+      b.data[len(b.data)-1] |= byte(value>>index&1) << (7 - b.bit%8)
+      b.bit++
+   }
+}
+
+func (b *bitWriter) ue(value uint32) {
+   value++
+   size := 0
+   for value>>size > 1 {
+      size++
+   }
+   b.u(size, 0)
+   b.u(size+1, value)
+}
+
+func TestSplitAnnexB(t *testing.T) {
+   data := []byte{0, 0, 0, 1, 0x67, 0xaa, 0, 0, 1, 0x68, 0xbb, 0, 0, 0, 1, 0x65}
+   units := splitAnnexB(data)
+   want := [][]byte{{0x67, 0xaa}, {0x68, 0xbb}, {0x65}}
+   if !slices.EqualFunc(units, want, bytes.Equal) {
+      t.Errorf("units = %x", units)
+   }
+}
+
+func TestUnescapeRbsp(t *testing.T) {
+   got := unescapeRbsp([]byte{1, 0, 0, 3, 1, 0, 0, 3, 0, 3})
+   if want := []byte{1, 0, 0, 1, 0, 0, 0, 3}; !bytes.Equal(got, want) {
+      t.Errorf("rbsp = %x, want %x", got, want)
+   }
+}
+
+func TestBitReader(t *testing.T) {
+   var w bitWriter
+   for _, value := range []uint32{0, 1, 2, 3, 200} {
+      w.ue(value)
+   }
+   w.u(3, 5)
+   b := bitReader{data: w.data}
+   for _, want := range []uint32{0, 1, 2, 3, 200} {
+      if got := b.ue(); got != want {
+         t.Errorf("ue = %d, want %d", got, want)
+      }
+   }
+   if got := b.u(3); got != 5 {
+      t.Errorf("u(3) = %d", got)
+   }
+   b = bitReader{data: []byte{0b01001100}}
+   if first, second := b.se(), b.se(); first != 1 || second != -1 {
+      t.Errorf("se = %d, %d", first, second)
+   }
+   b.u(8)
+   if b.err == nil {
+      t.Error("read past end: no error")
+   }
+}
+
+// avcSps builds the SPS NAL unit of a 1920x1080 baseline stream.
+func avcSps() []byte {
+   var w bitWriter
+   w.u(8, 66) // profile_idc
+   w.u(16, 30)
+   w.ue(0)   // seq_parameter_set_id
+   w.ue(0)   // log2_max_frame_num_minus4
+   w.ue(0)   // pic_order_cnt_type
+   w.ue(0)   // log2_max_pic_order_cnt_lsb_minus4
+   w.ue(1)   // max_num_ref_frames
+   w.u(1, 0) // gaps_in_frame_num_value_allowed_flag
+   w.ue(119) // pic_width_in_mbs_minus1
+   w.ue(67)  // pic_height_in_map_units_minus1
+   w.u(1, 1) // frame_mbs_only_flag
+   w.u(1, 1) // direct_8x8_inference_flag
+   w.u(1, 1) // frame_cropping_flag
+   w.ue(0)
+   w.ue(0)
+   w.ue(0)
+   w.ue(4)
+   w.u(1, 0) // vui_parameters_present_flag
+   w.u(1, 1) // rbsp_stop_one_bit
+   return append([]byte{0x67}, w.data...)
+}
+
+func TestParseAvcSps(t *testing.T) {
+   size, err := parseAvcSps(avcSps())
+   if err != nil {
+      t.Fatal(err)
+   }
+   if size.width != 1920 || size.height != 1080 {
+      t.Errorf("size = %dx%d", size.width, size.height)
+   }
+   if _, err := parseAvcSps([]byte{0x67, 66, 0}); err == nil {
+      t.Error("truncated: no error")
+   }
+}
+
+func TestParseAdts(t *testing.T) {
+   // AAC LC, 44.1 kHz, stereo, 3 bytes of payload
+   data := []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x5f, 0xfc, 1, 2, 3, 0xff}
+   frame, err := parseAdts(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if frame.sampleRate != 44100 || frame.channels != 2 || frame.size != 10 {
+      t.Errorf("rate %d, channels %d, size %d", frame.sampleRate, frame.channels, frame.size)
+   }
+   if !bytes.Equal(frame.config, []byte{0x12, 0x10}) || !bytes.Equal(frame.data, []byte{1, 2, 3}) {
+      t.Errorf("config %x, data %x", frame.config, frame.data)
+   }
+   if _, err := parseAdts(data[:9]); !errors.Is(err, errTruncatedFrame) {
+      t.Errorf("partial frame: %v", err)
+   }
+   if _, err := parseAdts([]byte{0xff, 0x01, 0, 0, 0, 0, 0}); err == nil || errors.Is(err, errTruncatedFrame) {
+      t.Errorf("bad sync word: %v", err)
+   }
+}
+
+func TestParseAc3(t *testing.T) {
+   // 48 kHz, frame size code 8, bsid 8, 2/0 with LFE
+   data := make([]byte, 256)
+   copy(data, []byte{0x0b, 0x77, 0, 0, 0x08, 0x40, 0x44})
+   frame, err := parseAc3(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if frame.sampleRate != 48000 || frame.channels != 3 || len(frame.data) != 256 {
+      t.Errorf("rate %d, channels %d, size %d", frame.sampleRate, frame.channels, len(frame.data))
+   }
+   if !bytes.Equal(frame.config, []byte{0x10, 0x14, 0x80}) {
+      t.Errorf("config = %x", frame.config)
+   }
+   if _, err := parseAc3(data[:255]); !errors.Is(err, errTruncatedFrame) {
+      t.Errorf("partial frame: %v", err)
+   }
+}
+
+// ts_codec_test.go
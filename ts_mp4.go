@@ -0,0 +1,568 @@
+package maya
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "log"
+   "slices"
+)
+
+// appendBox appends an ISO BMFF box made of the concatenated payloads.
+func appendBox(dst []byte, boxType string, payloads ...[]byte) []byte {
+   size := 8
+   for _, payload := range payloads {
+      size += len(payload)
+   }
+   dst = binary.BigEndian.AppendUint32(dst, uint32(size))
+   dst = append(dst, boxType...)
+   for _, payload := range payloads {
+      dst = append(dst, payload...)
+   }
+   return dst
+}
+
+func fullBoxHeader(version byte, flags uint32) []byte {
+   return binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+}
+
+// uint32s encodes values as big-endian 32-bit fields.
+func uint32s(values ...uint32) []byte {
+   var data []byte
+   for _, value := range values {
+      data = binary.BigEndian.AppendUint32(data, value)
+   }
+   return data
+}
+
+var unityMatrix = uint32s(0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000)
+
+// mp4Sample is one sample of a remuxed track. dts is in 90 kHz units.
+type mp4Sample struct {
+   dts  uint64
+   cto  int32
+   sync bool
+   data []byte
+}
+
+// tsTrack is an elementary stream of a transport stream remuxed to MP4.
+type tsTrack struct {
+   id         uint32
+   pid        int
+   streamType byte
+   timescale  uint32
+   // frameSize is the constant audio frame duration, in timescale units.
+   frameSize uint32
+   width     uint16
+   height    uint16
+   channels  uint16
+   // entry is the stsd sample entry, set once the codec configuration is
+   // known.
+   entry []byte
+   // vps, sps and pps are the first video parameter sets seen.
+   vps, sps, pps []byte
+   samples       []mp4Sample
+   // pending holds a partial audio frame carried into the next PES packet,
+   // and pendingDts the time of the PES packet it started in.
+   pending    []byte
+   pendingDts uint64
+   // wrap and last unwrap the 33-bit PES timestamps.
+   wrap, last uint64
+   // duration is the last video sample duration, in 90 kHz units.
+   duration uint64
+}
+
+func (t *tsTrack) isVideo() bool {
+   return t.streamType == tsStreamH264 || t.streamType == tsStreamHevc
+}
+
+// unwrap extends a 33-bit timestamp across wrap arounds.
+func (t *tsTrack) unwrap(timestamp uint64) uint64 {
+   timestamp += t.wrap
+   if t.last > timestamp && t.last-timestamp > 1<<32 {
+      t.wrap += 1 << 33
+      timestamp += 1 << 33
+   }
+   t.last = max(t.last, timestamp)
+   return timestamp
+}
+
+// addPes converts a PES packet to samples.
+func (t *tsTrack) addPes(pes *pesPacket) error {
+   if !pes.hasPts {
+      return errors.New("PES packet without PTS")
+   }
+   pts, dts := t.unwrap(pes.pts), t.unwrap(pes.dts)
+   switch t.streamType {
+   case tsStreamH264, tsStreamHevc:
+      return t.addVideo(pes.data, pts, dts)
+   case tsStreamAac:
+      return t.addAudio(pes.data, pts, func(data []byte) (int, error) {
+         frame, err := parseAdts(data)
+         if err != nil {
+            return 0, err
+         }
+         if t.entry == nil {
+            t.setAudio(frame.sampleRate, frame.channels, 1024, "mp4a", esdsBox(frame.config))
+         }
+         t.samples = append(t.samples, mp4Sample{sync: true, data: frame.data})
+         return frame.size, nil
+      })
+   case tsStreamAc3:
+      return t.addAudio(pes.data, pts, func(data []byte) (int, error) {
+         frame, err := parseAc3(data)
+         if err != nil {
+            return 0, err
+         }
+         if t.entry == nil {
+            t.setAudio(frame.sampleRate, frame.channels, 1536, "ac-3", appendBox(nil, "dac3", frame.config))
+         }
+         t.samples = append(t.samples, mp4Sample{sync: true, data: frame.data})
+         return len(frame.data), nil
+      })
+   }
+   return nil
+}
+
+// addVideo adds one access unit, converted to length prefixed NAL units.
+// Parameter sets go to the sample entry instead.
+func (t *tsTrack) addVideo(data []byte, pts, dts uint64) error {
+   var sample mp4Sample
+   for _, unit := range splitAnnexB(data) {
+      if len(unit) == 0 {
+         continue
+      }
+      if t.streamType == tsStreamH264 {
+         switch unit[0] & 0x1f {
+         case 5:
+            sample.sync = true
+         case 7:
+            t.sps = keepFirst(t.sps, unit)
+            continue
+         case 8:
+            t.pps = keepFirst(t.pps, unit)
+            continue
+         case 9:
+            continue
+         }
+      } else {
+         switch kind := unit[0] >> 1 & 0x3f; {
+         case kind >= 16 && kind <= 23:
+            sample.sync = true
+         case kind == 32:
+            t.vps = keepFirst(t.vps, unit)
+            continue
+         case kind == 33:
+            t.sps = keepFirst(t.sps, unit)
+            continue
+         case kind == 34:
+            t.pps = keepFirst(t.pps, unit)
+            continue
+         case kind == 35:
+            continue
+         }
+      }
+      sample.data = binary.BigEndian.AppendUint32(sample.data, uint32(len(unit)))
+      sample.data = append(sample.data, unit...)
+   }
+   if sample.data == nil {
+      return nil
+   }
+   if t.entry == nil {
+      if err := t.setVideo(); err != nil {
+         return err
+      }
+   }
+   sample.dts = dts
+   sample.cto = int32(int64(pts) - int64(dts))
+   t.samples = append(t.samples, sample)
+   return nil
+}
+
+// keepFirst returns current, or a copy of unit if current is unset.
+func keepFirst(current, unit []byte) []byte {
+   if current != nil {
+      return current
+   }
+   return slices.Clone(unit)
+}
+
+// setVideo builds the sample entry once the parameter sets are known.
+func (t *tsTrack) setVideo() error {
+   var format string
+   var config []byte
+   switch t.streamType {
+   case tsStreamH264:
+      if t.sps == nil || t.pps == nil {
+         return nil
+      }
+      size, err := parseAvcSps(t.sps)
+      if err != nil {
+         return err
+      }
+      t.width, t.height = size.width, size.height
+      format, config = "avc1", avcConfig(t.sps, t.pps)
+   case tsStreamHevc:
+      if t.vps == nil || t.sps == nil || t.pps == nil {
+         return nil
+      }
+      info, err := parseHevcSps(t.sps)
+      if err != nil {
+         return err
+      }
+      t.width, t.height = info.width, info.height
+      format, config = "hvc1", hevcConfig(info, t.vps, t.sps, t.pps)
+   }
+   fields := make([]byte, 78)
+   binary.BigEndian.PutUint16(fields[6:], 1) // data_reference_index
+   binary.BigEndian.PutUint16(fields[24:], t.width)
+   binary.BigEndian.PutUint16(fields[26:], t.height)
+   binary.BigEndian.PutUint32(fields[28:], 0x480000)
+   binary.BigEndian.PutUint32(fields[32:], 0x480000)
+   binary.BigEndian.PutUint16(fields[40:], 1) // frame_count
+   binary.BigEndian.PutUint16(fields[74:], 0x18)
+   binary.BigEndian.PutUint16(fields[76:], 0xffff)
+   t.timescale = 90000
+   t.entry = appendBox(nil, format, fields, config)
+   return nil
+}
+
+// setAudio builds an audio sample entry.
+func (t *tsTrack) setAudio(sampleRate uint32, channels uint16, frameSize uint32, format string, config []byte) {
+   fields := make([]byte, 28)
+   binary.BigEndian.PutUint16(fields[6:], 1) // data_reference_index
+   binary.BigEndian.PutUint16(fields[16:], channels)
+   binary.BigEndian.PutUint16(fields[18:], 16)
+   if sampleRate <= 0xffff {
+      binary.BigEndian.PutUint32(fields[24:], sampleRate<<16)
+   }
+   t.timescale = sampleRate
+   t.frameSize = frameSize
+   t.channels = channels
+   t.entry = appendBox(nil, format, fields, config)
+}
+
+// addAudio splits a PES payload into audio frames with parse, which adds
+// a sample and returns the size of the frame it read. A frame is timed
+// from the PES packet it started in.
+func (t *tsTrack) addAudio(data []byte, pts uint64, parse func([]byte) (int, error)) error {
+   carried := t.pending != nil
+   if carried {
+      data = append(t.pending, data...)
+      t.pending = nil
+   }
+   first := len(t.samples)
+   frameTime := func(frame int) uint64 {
+      return uint64(frame) * uint64(t.frameSize) * 90000 / uint64(t.timescale)
+   }
+   for len(data) > 0 {
+      size, err := parse(data)
+      if err != nil {
+         if errors.Is(err, errTruncatedFrame) {
+            t.pending = slices.Clone(data)
+            // frames of this packet parsed before the partial one
+            if count := len(t.samples) - first; !carried || count > 0 {
+               if carried {
+                  count--
+               }
+               t.pendingDts = pts + frameTime(count)
+            }
+            break
+         }
+         return err
+      }
+      data = data[size:]
+   }
+   for index := first; index < len(t.samples); index++ {
+      frame := index - first
+      if carried {
+         if frame == 0 {
+            t.samples[index].dts = t.pendingDts
+            continue
+         }
+         frame--
+      }
+      t.samples[index].dts = pts + frameTime(frame)
+   }
+   return nil
+}
+
+// tsRemuxer converts the MPEG-TS segments of a stream to fragments of one
+// fragmented MP4 file. Decode times start at zero.
+type tsRemuxer struct {
+   demuxer  tsDemuxer
+   tracks   map[int]*tsTrack
+   sequence uint32
+   // base is the first decode time of the output, in 90 kHz units.
+   base uint64
+}
+
+// newTsRemuxer probes the first segment of a stream for its elementary
+// streams and codec configurations, and returns a remuxer with the MP4 init
+// segment. Streams without a configuration are left out.
+func newTsRemuxer(first []byte) (*tsRemuxer, []byte, error) {
+   var probe tsRemuxer
+   if err := probe.demux(first); err != nil {
+      return nil, nil, err
+   }
+   remuxer := &tsRemuxer{tracks: make(map[int]*tsTrack)}
+   var tracks []*tsTrack
+   for _, pid := range probe.demuxer.pids {
+      track := probe.tracks[pid]
+      if track == nil || track.entry == nil {
+         log.Printf("skip TS PID %d: no codec configuration in first segment", pid)
+         continue
+      }
+      tracks = append(tracks, track)
+   }
+   if len(tracks) == 0 {
+      return nil, nil, errors.New("no supported streams in MPEG-TS segment")
+   }
+   remuxer.base = tracks[0].samples[0].dts
+   for _, track := range tracks {
+      remuxer.base = min(remuxer.base, track.samples[0].dts)
+   }
+   // video first, as players expect
+   slices.SortStableFunc(tracks, func(a, b *tsTrack) int {
+      if a.isVideo() == b.isVideo() {
+         return 0
+      }
+      if a.isVideo() {
+         return -1
+      }
+      return 1
+   })
+   for index, track := range tracks {
+      remuxer.tracks[track.pid] = &tsTrack{
+         id:         uint32(index + 1),
+         pid:        track.pid,
+         streamType: track.streamType,
+         timescale:  track.timescale,
+         frameSize:  track.frameSize,
+         entry:      track.entry,
+         vps:        track.vps,
+         sps:        track.sps,
+         pps:        track.pps,
+      }
+   }
+   return remuxer, buildTsInit(tracks), nil
+}
+
+// tsOutput is one track of a muxed stream, remuxed on its own.
+type tsOutput struct {
+   ts        *tsRemuxer
+   init      []byte
+   extension string
+}
+
+// split returns a remuxer for each track, in track order. The remuxers keep
+// the decode time base of r, so the tracks stay in sync.
+func (r *tsRemuxer) split() []*tsOutput {
+   var tracks []*tsTrack
+   for _, track := range r.tracks {
+      tracks = append(tracks, track)
+   }
+   slices.SortFunc(tracks, func(a, b *tsTrack) int {
+      return int(a.id) - int(b.id)
+   })
+   var outputs []*tsOutput
+   for _, track := range tracks {
+      single := *track
+      single.id = 1
+      output := &tsOutput{
+         ts:        &tsRemuxer{tracks: map[int]*tsTrack{track.pid: &single}, base: r.base},
+         init:      buildTsInit([]*tsTrack{&single}),
+         extension: ".m4a",
+      }
+      if track.isVideo() {
+         output.extension = ".mp4"
+      }
+      outputs = append(outputs, output)
+   }
+   return outputs
+}
+
+// hasVideo reports whether the remuxed file has a video track.
+func (r *tsRemuxer) hasVideo() bool {
+   for _, track := range r.tracks {
+      if track.isVideo() {
+         return true
+      }
+   }
+   return false
+}
+
+// demux adds the samples of a segment to the tracks. Tracks are created
+// for every supported stream while probing.
+func (r *tsRemuxer) demux(data []byte) error {
+   probing := r.tracks == nil
+   if probing {
+      r.tracks = make(map[int]*tsTrack)
+   }
+   return r.demuxer.demux(data, func(pid int, pes *pesPacket) error {
+      track := r.tracks[pid]
+      if track == nil {
+         if !probing {
+            return nil
+         }
+         track = &tsTrack{pid: pid, streamType: r.demuxer.streamTypes[pid]}
+         r.tracks[pid] = track
+      }
+      if err := track.addPes(pes); err != nil {
+         return fmt.Errorf("PID %d: %w", pid, err)
+      }
+      return nil
+   })
+}
+
+// fragment remuxes one segment to a moof and mdat. duration is the length
+// of the segment in seconds, which times the last video sample if no
+// earlier one was measured.
+func (r *tsRemuxer) fragment(data []byte, duration float64) ([]byte, error) {
+   if err := r.demux(data); err != nil {
+      return nil, err
+   }
+   var tracks []*tsTrack
+   for _, track := range r.tracks {
+      if len(track.samples) > 0 {
+         tracks = append(tracks, track)
+      }
+   }
+   if len(tracks) == 0 {
+      return nil, errors.New("MPEG-TS segment has no samples")
+   }
+   slices.SortFunc(tracks, func(a, b *tsTrack) int {
+      return int(a.id) - int(b.id)
+   })
+   r.sequence++
+   // the moof size does not depend on the data offsets, so build it once
+   // to measure it and again with the offsets
+   moof := r.buildMoof(tracks, 0, duration)
+   moof = r.buildMoof(tracks, uint32(len(moof)+8), duration)
+   var mdat [][]byte
+   for _, track := range tracks {
+      for _, sample := range track.samples {
+         mdat = append(mdat, sample.data)
+      }
+      track.samples = nil
+   }
+   return appendBox(moof, "mdat", mdat...), nil
+}
+
+// buildMoof writes a moof box with one traf per track. offset is the
+// position of the mdat payload relative to the start of the moof.
+func (r *tsRemuxer) buildMoof(tracks []*tsTrack, offset uint32, segmentDuration float64) []byte {
+   var trafs [][]byte
+   for _, track := range tracks {
+      first := track.samples[0].dts
+      if first < r.base {
+         first = r.base
+      }
+      decodeTime := (first - r.base) * uint64(track.timescale) / 90000
+      trun := fullBoxHeader(1, 0xf01)
+      trun = binary.BigEndian.AppendUint32(trun, uint32(len(track.samples)))
+      trun = binary.BigEndian.AppendUint32(trun, offset)
+      for index, sample := range track.samples {
+         duration := track.frameSize
+         if track.isVideo() {
+            if index+1 < len(track.samples) && track.samples[index+1].dts > sample.dts {
+               track.duration = track.samples[index+1].dts - sample.dts
+            } else if track.duration == 0 {
+               // no next sample to measure: last until the segment ends
+               end := track.samples[0].dts + uint64(segmentDuration*90000)
+               if end > sample.dts {
+                  track.duration = end - sample.dts
+               }
+            }
+            duration = uint32(track.duration)
+         }
+         flags := uint32(0x1010000)
+         if sample.sync {
+            flags = 0x2000000
+         }
+         trun = binary.BigEndian.AppendUint32(trun, duration)
+         trun = binary.BigEndian.AppendUint32(trun, uint32(len(sample.data)))
+         trun = binary.BigEndian.AppendUint32(trun, flags)
+         cto := int64(sample.cto) * int64(track.timescale) / 90000
+         trun = binary.BigEndian.AppendUint32(trun, uint32(int32(cto)))
+         offset += uint32(len(sample.data))
+      }
+      trafs = append(trafs, appendBox(nil, "traf",
+         appendBox(nil, "tfhd", fullBoxHeader(0, 0x20000), uint32s(track.id)),
+         appendBox(nil, "tfdt", fullBoxHeader(1, 0), binary.BigEndian.AppendUint64(nil, decodeTime)),
+         appendBox(nil, "trun", trun),
+      ))
+   }
+   return appendBox(nil, "moof",
+      append([][]byte{appendBox(nil, "mfhd", fullBoxHeader(0, 0), uint32s(r.sequence))}, trafs...)...,
+   )
+}
+
+// buildTsInit writes the ftyp and moov of the remuxed tracks.
+func buildTsInit(tracks []*tsTrack) []byte {
+   init := appendBox(nil, "ftyp", []byte("isom"), uint32s(0x200), []byte("isomiso6mp41"))
+   mvhd := fullBoxHeader(0, 0)
+   mvhd = append(mvhd, uint32s(0, 0, 1000, 0, 0x10000)...)
+   mvhd = append(mvhd, 0x01, 0x00)
+   mvhd = append(mvhd, make([]byte, 10)...)
+   mvhd = append(mvhd, unityMatrix...)
+   mvhd = append(mvhd, make([]byte, 24)...)
+   mvhd = binary.BigEndian.AppendUint32(mvhd, uint32(len(tracks)+1))
+
+   moov := [][]byte{appendBox(nil, "mvhd", mvhd)}
+   var mvex [][]byte
+   for index, track := range tracks {
+      id := uint32(index + 1)
+      tkhd := fullBoxHeader(0, 3)
+      tkhd = append(tkhd, uint32s(0, 0, id, 0, 0, 0, 0)...)
+      var volume uint16
+      if !track.isVideo() {
+         volume = 0x100
+      }
+      tkhd = append(tkhd, 0, 0, 0, 0) // layer and alternate_group
+      tkhd = binary.BigEndian.AppendUint16(tkhd, volume)
+      tkhd = append(tkhd, 0, 0)
+      tkhd = append(tkhd, unityMatrix...)
+      tkhd = append(tkhd, uint32s(uint32(track.width)<<16, uint32(track.height)<<16)...)
+
+      mdhd := fullBoxHeader(0, 0)
+      mdhd = append(mdhd, uint32s(0, 0, track.timescale, 0)...)
+      mdhd = append(mdhd, 0x55, 0xc4, 0, 0) // language "und"
+
+      handler, name := "soun", "SoundHandler"
+      header := appendBox(nil, "smhd", fullBoxHeader(0, 0), make([]byte, 4))
+      if track.isVideo() {
+         handler, name = "vide", "VideoHandler"
+         header = appendBox(nil, "vmhd", fullBoxHeader(0, 1), make([]byte, 8))
+      }
+      hdlr := fullBoxHeader(0, 0)
+      hdlr = append(hdlr, 0, 0, 0, 0)
+      hdlr = append(hdlr, handler...)
+      hdlr = append(hdlr, make([]byte, 12)...)
+      hdlr = append(hdlr, name+"\x00"...)
+
+      dinf := appendBox(nil, "dinf", appendBox(nil, "dref",
+         fullBoxHeader(0, 0), uint32s(1), appendBox(nil, "url ", fullBoxHeader(0, 1)),
+      ))
+      stbl := appendBox(nil, "stbl",
+         appendBox(nil, "stsd", fullBoxHeader(0, 0), uint32s(1), track.entry),
+         appendBox(nil, "stts", fullBoxHeader(0, 0), uint32s(0)),
+         appendBox(nil, "stsc", fullBoxHeader(0, 0), uint32s(0)),
+         appendBox(nil, "stsz", fullBoxHeader(0, 0), uint32s(0, 0)),
+         appendBox(nil, "stco", fullBoxHeader(0, 0), uint32s(0)),
+      )
+      moov = append(moov, appendBox(nil, "trak",
+         appendBox(nil, "tkhd", tkhd),
+         appendBox(nil, "mdia",
+            appendBox(nil, "mdhd", mdhd),
+            appendBox(nil, "hdlr", hdlr),
+            appendBox(nil, "minf", header, dinf, stbl),
+         ),
+      ))
+      mvex = append(mvex, appendBox(nil, "trex", fullBoxHeader(0, 0), uint32s(id, 1, 0, 0, 0)))
+   }
+   moov = append(moov, appendBox(nil, "mvex", mvex...))
+   return appendBox(init, "moov", moov...)
+}
+
+// ts_mp4.go
@@ -0,0 +1,207 @@
+package maya
+
+import (
+   "bytes"
+   "encoding/binary"
+   "slices"
+   "testing"
+)
+
+func TestAddAudioCarriedFrame(t *testing.T) {
+   track := &tsTrack{timescale: 48000, frameSize: 1024}
+   parse := func(data []byte) (int, error) {
+      if len(data) < 4 {
+         return 0, errTruncatedFrame
+      }
+      track.samples = append(track.samples, mp4Sample{data: data[:4]})
+      return 4, nil
+   }
+   // the second frame starts in the first packet and ends in the second
+   if err := track.addAudio(make([]byte, 6), 0, parse); err != nil {
+      t.Fatal(err)
+   }
+   if err := track.addAudio(make([]byte, 6), 5000, parse); err != nil {
+      t.Fatal(err)
+   }
+   var times []uint64
+   for _, sample := range track.samples {
+      times = append(times, sample.dts)
+   }
+   if want := []uint64{0, 1920, 5000}; !slices.Equal(times, want) {
+      t.Errorf("times = %v, want %v", times, want)
+   }
+}
+
+// tsPackets splits a payload into TS packets of pid, the last one padded
+// with an adaptation field.
+func tsPackets(pid int, payload []byte) []byte {
+   var data []byte
+   for start := true; start || len(payload) > 0; start = false {
+      header := []byte{0x47, byte(pid >> 8), byte(pid), 0x10}
+      if start {
+         header[1] |= 0x40
+      }
+      size := min(len(payload), 184)
+      if size < 184 {
+         header[3] = 0x30
+         stuffing := 183 - size
+         header = append(header, byte(stuffing))
+         if stuffing > 0 {
+            header = append(header, 0)
+            header = append(header, bytes.Repeat([]byte{0xff}, stuffing-1)...)
+         }
+      }
+      data = append(data, header...)
+      data = append(data, payload[:size]...)
+      payload = payload[size:]
+   }
+   return data
+}
+
+// psiPayload builds a PSI section with a pointer field and a blank CRC.
+func psiPayload(tableId byte, body []byte) []byte {
+   size := 5 + len(body) + 4
+   section := []byte{0, tableId, 0xb0 | byte(size>>8), byte(size), 0, 1, 0xc1, 0, 0}
+   section = append(section, body...)
+   return append(section, 0, 0, 0, 0)
+}
+
+func pesTimestamp(prefix byte, value uint64) []byte {
+   return []byte{
+      prefix<<4 | byte(value>>30&7)<<1 | 1, byte(value >> 22), byte(value>>15)<<1 | 1,
+      byte(value >> 7), byte(value)<<1 | 1,
+   }
+}
+
+// pesPayload builds a PES packet with a PTS and DTS.
+func pesPayload(streamId byte, pts, dts uint64, data []byte) []byte {
+   pes := []byte{0, 0, 1, streamId, 0, 0, 0x80, 0xc0, 10}
+   pes = append(pes, pesTimestamp(3, pts)...)
+   pes = append(pes, pesTimestamp(1, dts)...)
+   return append(pes, data...)
+}
+
+// muxedTsSegment builds a segment with an H.264 stream on PID 0x100 and an
+// AAC stream on PID 0x101. Video starts at 9000 and audio at 9900.
+func muxedTsSegment() []byte {
+   startCode := []byte{0, 0, 0, 1}
+   idr := slices.Concat(startCode, avcSps(), startCode, []byte{0x68, 0xce, 0x3c, 0x80}, startCode, []byte{0x65, 0x88, 0x84})
+   frame := slices.Concat(startCode, []byte{0x41, 0x9a})
+   adts := []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x5f, 0xfc, 1, 2, 3}
+   return slices.Concat(
+      tsPackets(0, psiPayload(0, []byte{0, 1, 0xf0, 0})),
+      tsPackets(0x1000, psiPayload(2, []byte{
+         0xe1, 0, 0xf0, 0,
+         0x1b, 0xe1, 0, 0xf0, 0,
+         0x0f, 0xe1, 1, 0xf0, 0,
+      })),
+      tsPackets(0x100, pesPayload(0xe0, 12000, 9000, idr)),
+      tsPackets(0x101, pesPayload(0xc0, 9900, 9900, slices.Concat(adts, adts))),
+      tsPackets(0x100, pesPayload(0xe0, 15000, 12000, frame)),
+   )
+}
+
+// trafSummary is the track ID, decode time and trun fields of a traf.
+type trafSummary struct {
+   trackId    uint32
+   decodeTime uint64
+   dataOffset uint32
+   // samples holds the duration, size, flags and composition offset of
+   // each sample.
+   samples [][4]uint32
+}
+
+func readTrafs(t *testing.T, fragment []byte) []trafSummary {
+   t.Helper()
+   var summaries []trafSummary
+   for _, traf := range findBoxes(fragment, "moof", "traf") {
+      var summary trafSummary
+      summary.trackId = binary.BigEndian.Uint32(findBoxes(traf.Payload, "tfhd")[0].Payload[4:])
+      decodeTime, err := readTfdt(findBoxes(traf.Payload, "tfdt")[0].Payload)
+      if err != nil {
+         t.Fatal(err)
+      }
+      summary.decodeTime = decodeTime
+      trun := findBoxes(traf.Payload, "trun")[0].Payload
+      summary.dataOffset = binary.BigEndian.Uint32(trun[8:])
+      for fields := trun[12:]; len(fields) >= 16; fields = fields[16:] {
+         summary.samples = append(summary.samples, [4]uint32{
+            binary.BigEndian.Uint32(fields), binary.BigEndian.Uint32(fields[4:]),
+            binary.BigEndian.Uint32(fields[8:]), binary.BigEndian.Uint32(fields[12:]),
+         })
+      }
+      summaries = append(summaries, summary)
+   }
+   return summaries
+}
+
+func handlers(init []byte) []string {
+   var names []string
+   for _, hdlr := range findBoxes(init, "moov", "trak", "mdia", "hdlr") {
+      names = append(names, string(hdlr.Payload[8:12]))
+   }
+   return names
+}
+
+func TestTsRemuxerMuxed(t *testing.T) {
+   segment := muxedTsSegment()
+   remuxer, init, err := newTsRemuxer(segment)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if got := handlers(init); !slices.Equal(got, []string{"vide", "soun"}) {
+      t.Errorf("handlers = %v", got)
+   }
+   if trex := findBoxes(init, "moov", "mvex", "trex"); len(trex) != 2 {
+      t.Errorf("%d trex boxes", len(trex))
+   }
+   fragment, err := remuxer.fragment(segment, 2)
+   if err != nil {
+      t.Fatal(err)
+   }
+   moof := findBoxes(fragment, "moof")[0]
+   trafs := readTrafs(t, fragment)
+   if len(trafs) != 2 {
+      t.Fatalf("%d trafs", len(trafs))
+   }
+   video, audio := trafs[0], trafs[1]
+   if video.trackId != 1 || video.decodeTime != 0 || video.dataOffset != uint32(len(moof.Payload)+16) {
+      t.Errorf("video traf %+v", video)
+   }
+   // 4 byte length, then the 3 byte IDR NAL unit; the next frame lasts as
+   // long as the measured one
+   wantVideo := [][4]uint32{{3000, 7, 0x2000000, 3000}, {3000, 6, 0x1010000, 3000}}
+   if !slices.Equal(video.samples, wantVideo) {
+      t.Errorf("video samples %v, want %v", video.samples, wantVideo)
+   }
+   // 900 ticks at 90 kHz after the video
+   if audio.trackId != 2 || audio.decodeTime != 441 || audio.dataOffset != video.dataOffset+13 {
+      t.Errorf("audio traf %+v", audio)
+   }
+   if len(audio.samples) != 2 || audio.samples[0][0] != 1024 || audio.samples[0][1] != 3 {
+      t.Errorf("audio samples %v", audio.samples)
+   }
+   mdat := findBoxes(fragment, "mdat")[0].Payload
+   if !bytes.Equal(mdat[:7], []byte{0, 0, 0, 3, 0x65, 0x88, 0x84}) {
+      t.Errorf("mdat starts %x", mdat[:7])
+   }
+
+   outputs := remuxer.split()
+   if len(outputs) != 2 || outputs[0].extension != ".mp4" || outputs[1].extension != ".m4a" {
+      t.Fatalf("outputs %+v", outputs)
+   }
+   if got := handlers(outputs[1].init); !slices.Equal(got, []string{"soun"}) {
+      t.Errorf("audio handlers = %v", got)
+   }
+   fragment, err = outputs[1].ts.fragment(segment, 2)
+   if err != nil {
+      t.Fatal(err)
+   }
+   // split tracks keep the shared base
+   trafs = readTrafs(t, fragment)
+   if len(trafs) != 1 || trafs[0].trackId != 1 || trafs[0].decodeTime != 441 {
+      t.Errorf("split audio trafs %+v", trafs)
+   }
+}
+
+// ts_mp4_test.go
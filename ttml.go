@@ -0,0 +1,226 @@
+package maya
+
+import (
+   "bytes"
+   "encoding/xml"
+   "errors"
+   "fmt"
+   "io"
+   "strconv"
+   "strings"
+   "time"
+)
+
+// ttmlClock holds the tt attributes needed to read TTML time expressions.
+type ttmlClock struct {
+   tickRate  float64
+   frameRate float64
+}
+
+// parseTtml decodes the p elements of a TTML document into cues. start and
+// end bound the segment or sample holding it, and are zero for a whole
+// document. A p without end or dur lasts until end, or an hour without one.
+func (s *subtitleWriter) parseTtml(data []byte, start, end time.Duration) ([]cue, error) {
+   clock := ttmlClock{tickRate: 1, frameRate: 30}
+   decoder := xml.NewDecoder(bytes.NewReader(data))
+   // begin times of the open timed elements
+   var begins []time.Duration
+   var cues []cue
+   var current *cue
+   var text strings.Builder
+   var italic []bool
+   for {
+      token, err := decoder.Token()
+      if errors.Is(err, io.EOF) {
+         break
+      }
+      if err != nil {
+         return nil, fmt.Errorf("TTML: %w", err)
+      }
+      switch element := token.(type) {
+      case xml.StartElement:
+         attributes := make(map[string]string)
+         for _, attribute := range element.Attr {
+            attributes[attribute.Name.Local] = attribute.Value
+         }
+         switch element.Name.Local {
+         case "tt":
+            if value, err := strconv.ParseFloat(attributes["tickRate"], 64); err == nil && value > 0 {
+               clock.tickRate = value
+            }
+            if value, err := strconv.ParseFloat(attributes["frameRate"], 64); err == nil && value > 0 {
+               clock.frameRate = value
+            }
+            continue
+         case "br":
+            if current != nil {
+               text.WriteByte('\n')
+            }
+            continue
+         }
+         parent := time.Duration(0)
+         if len(begins) > 0 {
+            parent = begins[len(begins)-1]
+         }
+         begin, end, err := clock.interval(attributes, parent)
+         if err != nil {
+            return nil, err
+         }
+         begins = append(begins, begin)
+         isItalic := attributes["fontStyle"] == "italic"
+         italic = append(italic, isItalic)
+         if element.Name.Local == "p" {
+            current = &cue{start: begin, end: end}
+            text.Reset()
+         }
+         if current != nil && isItalic {
+            text.WriteString("<i>")
+         }
+      case xml.EndElement:
+         switch element.Name.Local {
+         case "tt", "br":
+            continue
+         }
+         if len(begins) == 0 {
+            continue
+         }
+         if current != nil && italic[len(italic)-1] {
+            text.WriteString("</i>")
+         }
+         begins = begins[:len(begins)-1]
+         italic = italic[:len(italic)-1]
+         if element.Name.Local == "p" && current != nil {
+            current.text = cleanTtmlText(text.String())
+            cues = append(cues, *current)
+            current = nil
+         }
+      case xml.CharData:
+         if current != nil {
+            // space between elements separates words, as in "<span>a</span> b"
+            if len(element) > 0 && isSpace(element[0]) && !strings.HasSuffix(text.String(), " ") {
+               text.WriteByte(' ')
+            }
+            words := strings.Join(strings.Fields(string(element)), " ")
+            text.WriteString(words)
+            if words != "" && isSpace(element[len(element)-1]) {
+               text.WriteByte(' ')
+            }
+         }
+      }
+   }
+   relative := s.relativeTo(cues, start, end)
+   for index := range cues {
+      item := &cues[index]
+      if relative {
+         item.start += start
+         if item.end >= 0 {
+            item.end += start
+         }
+      }
+      if item.end < 0 {
+         item.end = item.start + time.Hour
+         if end > 0 {
+            item.end = end
+         }
+      }
+      if end > 0 {
+         item.end = min(item.end, end)
+      }
+   }
+   return cues, nil
+}
+
+func isSpace(b byte) bool {
+   return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+// cleanTtmlText trims the space around line breaks and escapes the text for
+// WebVTT.
+func cleanTtmlText(text string) string {
+   lines := strings.Split(text, "\n")
+   for index, line := range lines {
+      lines[index] = strings.TrimSpace(line)
+   }
+   text = strings.Join(lines, "\n")
+   text = strings.ReplaceAll(text, "&", "&amp;")
+   text = strings.ReplaceAll(text, "<i>", "\x00i")
+   text = strings.ReplaceAll(text, "</i>", "\x00/i")
+   text = strings.ReplaceAll(text, "<", "&lt;")
+   text = strings.ReplaceAll(text, ">", "&gt;")
+   text = strings.ReplaceAll(text, "\x00i", "<i>")
+   return strings.ReplaceAll(text, "\x00/i", "</i>")
+}
+
+// interval returns the begin and end of a timed element. Times are
+// relative to the begin of the parent; a missing end lasts until dur or,
+// failing that, is returned as -1, for an open-ended cue.
+func (c ttmlClock) interval(attributes map[string]string, parent time.Duration) (time.Duration, time.Duration, error) {
+   begin := parent
+   if value, ok := attributes["begin"]; ok {
+      offset, err := c.parse(value)
+      if err != nil {
+         return 0, 0, err
+      }
+      begin += offset
+   }
+   end := time.Duration(-1)
+   if value, ok := attributes["end"]; ok {
+      offset, err := c.parse(value)
+      if err != nil {
+         return 0, 0, err
+      }
+      end = parent + offset
+   } else if value, ok := attributes["dur"]; ok {
+      duration, err := c.parse(value)
+      if err != nil {
+         return 0, 0, err
+      }
+      end = begin + duration
+   }
+   return begin, end, nil
+}
+
+// parse reads a TTML clock time, such as 00:01:02.500 or 00:01:02:12, or an
+// offset time, such as 62.5s, 500ms or 900t.
+func (c ttmlClock) parse(value string) (time.Duration, error) {
+   value = strings.TrimSpace(value)
+   if parts := strings.Split(value, ":"); len(parts) >= 3 {
+      var seconds float64
+      for index, unit := range []float64{3600, 60, 1} {
+         number, err := strconv.ParseFloat(parts[index], 64)
+         if err != nil {
+            return 0, fmt.Errorf("invalid TTML time %q", value)
+         }
+         seconds += number * unit
+      }
+      if len(parts) == 4 {
+         frames, err := strconv.ParseFloat(parts[3], 64)
+         if err != nil {
+            return 0, fmt.Errorf("invalid TTML time %q", value)
+         }
+         seconds += frames / c.frameRate
+      }
+      return secondsToDuration(seconds), nil
+   }
+   for _, metric := range []struct {
+      suffix string
+      scale  float64
+   }{
+      {"ms", 0.001}, {"h", 3600}, {"m", 60}, {"s", 1}, {"f", 1 / c.frameRate}, {"t", 1 / c.tickRate},
+   } {
+      if number, ok := strings.CutSuffix(value, metric.suffix); ok {
+         count, err := strconv.ParseFloat(number, 64)
+         if err != nil {
+            return 0, fmt.Errorf("invalid TTML time %q", value)
+         }
+         return secondsToDuration(count * metric.scale), nil
+      }
+   }
+   return 0, fmt.Errorf("invalid TTML time %q", value)
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+   return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+}
+
+// ttml.go
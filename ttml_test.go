@@ -0,0 +1,92 @@
+package maya
+
+import (
+   "slices"
+   "testing"
+   "time"
+)
+
+func TestParseTtml(t *testing.T) {
+   const document = `<tt xmlns="http://www.w3.org/ns/ttml"
+   xmlns:ttp="http://www.w3.org/ns/ttml#parameter"
+   xmlns:tts="http://www.w3.org/ns/ttml#styling" ttp:tickRate="10000000">
+<body><div begin="10s">
+<p begin="1s" end="2s">Hello<br/> world</p>
+<p begin="20000000t" dur="1s"><span tts:fontStyle="italic">Hi</span> &lt;there&gt;</p>
+<p begin="5s">Open</p>
+</div></body></tt>`
+   tests := []struct {
+      name       string
+      data       string
+      start, end time.Duration
+      want       []cue
+   }{
+      {"document", document, 0, 0, []cue{
+         {start: 11 * time.Second, end: 12 * time.Second, text: "Hello\nworld"},
+         {start: 12 * time.Second, end: 13 * time.Second, text: "<i>Hi</i> &lt;there&gt;"},
+         {start: 15 * time.Second, end: 15*time.Second + time.Hour, text: "Open"},
+      }},
+      {
+         "sample timed from the sample",
+         `<tt><body><p begin="00:00:01.000" end="00:00:02.000">A</p><p begin="00:00:03.000">B</p></body></tt>`,
+         100 * time.Second, 104 * time.Second,
+         []cue{
+            {start: 101 * time.Second, end: 102 * time.Second, text: "A"},
+            {start: 103 * time.Second, end: 104 * time.Second, text: "B"},
+         },
+      },
+      {
+         "sample timed from the track",
+         `<tt><body><p begin="100.5s" end="200s">A</p><p begin="99s" end="101s">B</p></body></tt>`,
+         100 * time.Second, 102 * time.Second,
+         []cue{
+            {start: 100500 * time.Millisecond, end: 102 * time.Second, text: "A"},
+            {start: 99 * time.Second, end: 101 * time.Second, text: "B"},
+         },
+      },
+      {
+         "sample timed from the track before it",
+         `<tt><body><p begin="30s" end="32s">A</p></body></tt>`,
+         100 * time.Second, 104 * time.Second,
+         []cue{{start: 30 * time.Second, end: 32 * time.Second, text: "A"}},
+      },
+   }
+   for _, test := range tests {
+      cues, err := (&subtitleWriter{}).parseTtml([]byte(test.data), test.start, test.end)
+      if err != nil {
+         t.Fatalf("%s: %v", test.name, err)
+      }
+      if !slices.Equal(cues, test.want) {
+         t.Errorf("%s: %+v, want %+v", test.name, cues, test.want)
+      }
+   }
+}
+
+func TestTtmlClockParse(t *testing.T) {
+   clock := ttmlClock{tickRate: 1000, frameRate: 25}
+   tests := map[string]time.Duration{
+      "00:01:02.500": 62500 * time.Millisecond,
+      "00:00:01:05":  1200 * time.Millisecond,
+      "62.5s":        62500 * time.Millisecond,
+      "500ms":        500 * time.Millisecond,
+      "2m":           2 * time.Minute,
+      "1.5h":         90 * time.Minute,
+      "50f":          2 * time.Second,
+      "900t":         900 * time.Millisecond,
+   }
+   for value, want := range tests {
+      got, err := clock.parse(value)
+      if err != nil {
+         t.Errorf("%s: %v", value, err)
+      } else if got != want {
+         t.Errorf("%s: %v, want %v", value, got, want)
+      }
+   }
+   for _, value := range []string{"", "1.5", "a:b:c", "12x"} {
+      if _, err := clock.parse(value); err == nil {
+         t.Errorf("%q: no error", value)
+      }
+   }
+}
+
+// ttml_test.go
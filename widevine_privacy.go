@@ -0,0 +1,212 @@
+package maya
+
+import (
+   "crypto"
+   "crypto/aes"
+   "crypto/cipher"
+   "crypto/rand"
+   "crypto/rsa"
+   "crypto/sha1"
+   "crypto/x509"
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "log"
+)
+
+// widevineCertificateRequest is a SignedMessage of type
+// SERVICE_CERTIFICATE_REQUEST.
+var widevineCertificateRequest = []byte{0x08, 0x04}
+
+// serviceCertificate is a verified Widevine service certificate.
+type serviceCertificate struct {
+   SerialNumber []byte
+   ProviderId   string
+   PublicKey    *rsa.PublicKey
+}
+
+// parseServiceCertificate decodes a service certificate response, which is
+// either a SignedMessage of type SERVICE_CERTIFICATE or a bare
+// SignedDrmCertificate. The signature is verified with the Widevine root
+// key; certificates that cannot be verified are rejected.
+func parseServiceCertificate(response []byte, root *rsa.PublicKey) (*serviceCertificate, error) {
+   if root == nil {
+      return nil, errors.New("service certificate cannot be verified: no Widevine root key")
+   }
+   fields, err := parseProtobuf(response)
+   if err != nil {
+      return nil, fmt.Errorf("malformed service certificate response: %w", err)
+   }
+   if field := findProtobufField(fields, 1); field != nil && field.WireType == 0 {
+      const serviceCertificateType = 5
+      if field.Varint != serviceCertificateType {
+         return nil, fmt.Errorf("unexpected message type %d for service certificate", field.Varint)
+      }
+      msg := findProtobufField(fields, 2)
+      if msg == nil {
+         return nil, errors.New("service certificate message is empty")
+      }
+      fields, err = parseProtobuf(msg.Bytes)
+      if err != nil {
+         return nil, fmt.Errorf("malformed signed certificate: %w", err)
+      }
+   }
+   certificate, signature := findProtobufField(fields, 1), findProtobufField(fields, 2)
+   if certificate == nil || signature == nil {
+      return nil, errors.New("signed certificate is missing certificate or signature")
+   }
+   digest := sha1.Sum(certificate.Bytes)
+   err = rsa.VerifyPSS(root, crypto.SHA1, digest[:], signature.Bytes, &rsa.PSSOptions{
+      SaltLength: rsa.PSSSaltLengthAuto,
+   })
+   if err != nil {
+      return nil, fmt.Errorf("service certificate signature: %w", err)
+   }
+
+   fields, err = parseProtobuf(certificate.Bytes)
+   if err != nil {
+      return nil, fmt.Errorf("malformed service certificate: %w", err)
+   }
+   const serviceType = 3
+   if field := findProtobufField(fields, 1); field == nil || field.Varint != serviceType {
+      return nil, errors.New("certificate is not a service certificate")
+   }
+   var service serviceCertificate
+   if field := findProtobufField(fields, 2); field != nil {
+      service.SerialNumber = field.Bytes
+   }
+   if field := findProtobufField(fields, 7); field != nil {
+      service.ProviderId = string(field.Bytes)
+   }
+   field := findProtobufField(fields, 4)
+   if field == nil {
+      return nil, errors.New("service certificate has no public key")
+   }
+   service.PublicKey, err = x509.ParsePKCS1PublicKey(field.Bytes)
+   if err != nil {
+      return nil, fmt.Errorf("service certificate public key: %w", err)
+   }
+   log.Printf("service certificate: %s", service.ProviderId)
+   return &service, nil
+}
+
+// encryptClientId replaces the client_id field of a LicenseRequest with an
+// EncryptedClientIdentification for the service certificate.
+func (s *serviceCertificate) encryptClientId(request, clientId []byte) ([]byte, error) {
+   privacyKey := make([]byte, 16)
+   privacyIv := make([]byte, aes.BlockSize)
+   if _, err := rand.Read(privacyKey); err != nil {
+      return nil, err
+   }
+   if _, err := rand.Read(privacyIv); err != nil {
+      return nil, err
+   }
+   block, err := aes.NewCipher(privacyKey)
+   if err != nil {
+      return nil, err
+   }
+   padding := aes.BlockSize - len(clientId)%aes.BlockSize
+   encrypted := make([]byte, len(clientId), len(clientId)+padding)
+   copy(encrypted, clientId)
+   for range padding {
+      encrypted = append(encrypted, byte(padding))
+   }
+   cipher.NewCBCEncrypter(block, privacyIv).CryptBlocks(encrypted, encrypted)
+
+   encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, s.PublicKey, privacyKey, nil)
+   if err != nil {
+      return nil, err
+   }
+
+   var message []byte
+   message = appendProtobufBytes(message, 1, []byte(s.ProviderId))
+   message = appendProtobufBytes(message, 2, s.SerialNumber)
+   message = appendProtobufBytes(message, 3, encrypted)
+   message = appendProtobufBytes(message, 4, privacyIv)
+   message = appendProtobufBytes(message, 5, encryptedKey)
+
+   fields, err := parseProtobuf(request)
+   if err != nil {
+      return nil, fmt.Errorf("malformed license request: %w", err)
+   }
+   var result []byte
+   for _, field := range fields {
+      if field.Number != 1 {
+         result = append(result, field.Raw...)
+      }
+   }
+   return appendProtobufBytes(result, 8, message), nil
+}
+
+// protobufField is one field of an encoded protobuf message.
+type protobufField struct {
+   Number   uint64
+   WireType uint64
+   Varint   uint64
+   Bytes    []byte
+   // Raw is the complete encoding of the field, including its tag.
+   Raw []byte
+}
+
+// findProtobufField returns the first field with the given number.
+func findProtobufField(fields []protobufField, number uint64) *protobufField {
+   for index := range fields {
+      if fields[index].Number == number {
+         return &fields[index]
+      }
+   }
+   return nil
+}
+
+// parseProtobuf splits an encoded protobuf message into its fields.
+func parseProtobuf(data []byte) ([]protobufField, error) {
+   var fields []protobufField
+   for len(data) > 0 {
+      start := data
+      tag, n := binary.Uvarint(data)
+      if n <= 0 {
+         return nil, errors.New("invalid field tag")
+      }
+      data = data[n:]
+      field := protobufField{Number: tag >> 3, WireType: tag & 7}
+      switch field.WireType {
+      case 0:
+         field.Varint, n = binary.Uvarint(data)
+         if n <= 0 {
+            return nil, errors.New("invalid varint")
+         }
+         data = data[n:]
+      case 1:
+         if len(data) < 8 {
+            return nil, errors.New("truncated fixed64")
+         }
+         data = data[8:]
+      case 2:
+         size, n := binary.Uvarint(data)
+         if n <= 0 || size > uint64(len(data)-n) {
+            return nil, errors.New("truncated length-delimited field")
+         }
+         field.Bytes = data[n : n+int(size)]
+         data = data[n+int(size):]
+      case 5:
+         if len(data) < 4 {
+            return nil, errors.New("truncated fixed32")
+         }
+         data = data[4:]
+      default:
+         return nil, fmt.Errorf("unsupported wire type %d", field.WireType)
+      }
+      field.Raw = start[:len(start)-len(data)]
+      fields = append(fields, field)
+   }
+   return fields, nil
+}
+
+// appendProtobufBytes appends a length-delimited field.
+func appendProtobufBytes(dst []byte, number uint64, value []byte) []byte {
+   dst = binary.AppendUvarint(dst, number<<3|2)
+   dst = binary.AppendUvarint(dst, uint64(len(value)))
+   return append(dst, value...)
+}
+
+// widevine_privacy.go
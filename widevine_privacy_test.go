@@ -0,0 +1,141 @@
+package maya
+
+import (
+   "bytes"
+   "crypto"
+   "crypto/aes"
+   "crypto/cipher"
+   "crypto/rand"
+   "crypto/rsa"
+   "crypto/sha1"
+   "crypto/x509"
+   "encoding/binary"
+   "testing"
+)
+
+func TestParseProtobuf(t *testing.T) {
+   var message []byte
+   message = binary.AppendUvarint(message, 1<<3|0)
+   message = binary.AppendUvarint(message, 300)
+   message = appendProtobufBytes(message, 2, []byte("value"))
+   message = binary.AppendUvarint(message, 3<<3|1)
+   message = append(message, make([]byte, 8)...)
+   message = binary.AppendUvarint(message, 4<<3|5)
+   message = append(message, make([]byte, 4)...)
+   fields, err := parseProtobuf(message)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(fields) != 4 {
+      t.Fatalf("got %d fields, want 4", len(fields))
+   }
+   if field := findProtobufField(fields, 1); field == nil || field.Varint != 300 {
+      t.Errorf("field 1 = %+v", field)
+   }
+   if field := findProtobufField(fields, 2); field == nil || string(field.Bytes) != "value" {
+      t.Errorf("field 2 = %+v", field)
+   }
+   var raw []byte
+   for _, field := range fields {
+      raw = append(raw, field.Raw...)
+   }
+   if !bytes.Equal(raw, message) {
+      t.Error("raw fields do not reassemble the message")
+   }
+   for _, bad := range [][]byte{{0x12, 0x05, 'a'}, {0x0b}, {0x80}} {
+      if _, err := parseProtobuf(bad); err == nil {
+         t.Errorf("%x: no error", bad)
+      }
+   }
+}
+
+// signedServiceCertificate returns a SignedMessage of type
+// SERVICE_CERTIFICATE for public, signed with root.
+func signedServiceCertificate(t *testing.T, root *rsa.PrivateKey, public *rsa.PublicKey) []byte {
+   var certificate []byte
+   certificate = binary.AppendUvarint(certificate, 1<<3|0)
+   certificate = binary.AppendUvarint(certificate, 3)
+   certificate = appendProtobufBytes(certificate, 2, []byte("serial"))
+   certificate = appendProtobufBytes(certificate, 4, x509.MarshalPKCS1PublicKey(public))
+   certificate = appendProtobufBytes(certificate, 7, []byte("provider"))
+   digest := sha1.Sum(certificate)
+   signature, err := rsa.SignPSS(rand.Reader, root, crypto.SHA1, digest[:], nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   var signed []byte
+   signed = appendProtobufBytes(signed, 1, certificate)
+   signed = appendProtobufBytes(signed, 2, signature)
+   var message []byte
+   message = binary.AppendUvarint(message, 1<<3|0)
+   message = binary.AppendUvarint(message, 5)
+   return appendProtobufBytes(message, 2, signed)
+}
+
+func TestServiceCertificate(t *testing.T) {
+   root, err := rsa.GenerateKey(rand.Reader, 2048)
+   if err != nil {
+      t.Fatal(err)
+   }
+   service, err := rsa.GenerateKey(rand.Reader, 2048)
+   if err != nil {
+      t.Fatal(err)
+   }
+   response := signedServiceCertificate(t, root, &service.PublicKey)
+
+   if _, err := parseServiceCertificate(response, nil); err == nil {
+      t.Error("certificate accepted without a root key")
+   }
+   if _, err := parseServiceCertificate(response, &service.PublicKey); err == nil {
+      t.Error("certificate accepted with the wrong root key")
+   }
+   certificate, err := parseServiceCertificate(response, &root.PublicKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if certificate.ProviderId != "provider" || string(certificate.SerialNumber) != "serial" {
+      t.Errorf("certificate = %+v", certificate)
+   }
+
+   clientId := []byte("client identification")
+   var request []byte
+   request = appendProtobufBytes(request, 1, clientId)
+   request = appendProtobufBytes(request, 2, []byte("content"))
+   encrypted, err := certificate.encryptClientId(request, clientId)
+   if err != nil {
+      t.Fatal(err)
+   }
+   fields, err := parseProtobuf(encrypted)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if findProtobufField(fields, 1) != nil {
+      t.Error("clear client ID left in the request")
+   }
+   if field := findProtobufField(fields, 2); field == nil || string(field.Bytes) != "content" {
+      t.Error("other request fields not kept")
+   }
+   field := findProtobufField(fields, 8)
+   if field == nil {
+      t.Fatal("no encrypted client ID")
+   }
+   message, err := parseProtobuf(field.Bytes)
+   if err != nil {
+      t.Fatal(err)
+   }
+   privacyKey, err := rsa.DecryptOAEP(sha1.New(), nil, service, findProtobufField(message, 5).Bytes, nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   block, err := aes.NewCipher(privacyKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   data := bytes.Clone(findProtobufField(message, 3).Bytes)
+   cipher.NewCBCDecrypter(block, findProtobufField(message, 4).Bytes).CryptBlocks(data, data)
+   if !bytes.HasPrefix(data, clientId) {
+      t.Errorf("decrypted client ID = %q", data)
+   }
+}
+
+// widevine_privacy_test.go
@@ -0,0 +1,96 @@
+package maya
+
+import (
+   "encoding/binary"
+   "encoding/pem"
+   "errors"
+   "fmt"
+   "log"
+   "os"
+   "path/filepath"
+)
+
+// widevineDevice is a Widevine client identification blob with its RSA
+// private key in PEM form.
+type widevineDevice struct {
+   ClientId      []byte
+   PrivateKey    []byte
+   Type          uint8
+   SecurityLevel uint8
+}
+
+// loadWidevineDevice reads a device from a .wvd file, or from a directory
+// holding device_client_id_blob and device_private_key.
+func loadWidevineDevice(device string) (*widevineDevice, error) {
+   stat, err := os.Stat(device)
+   if err != nil {
+      return nil, err
+   }
+   if !stat.IsDir() {
+      data, err := os.ReadFile(device)
+      if err != nil {
+         return nil, err
+      }
+      wvd, err := parseWvd(data)
+      if err != nil {
+         return nil, fmt.Errorf("invalid WVD file %s: %w", device, err)
+      }
+      log.Printf("WVD device: type %d, security level %d", wvd.Type, wvd.SecurityLevel)
+      return wvd, nil
+   }
+
+   client_id, err := os.ReadFile(filepath.Join(device, "device_client_id_blob"))
+   if err != nil {
+      return nil, err
+   }
+
+   pem_data, err := os.ReadFile(filepath.Join(device, "device_private_key"))
+   if err != nil {
+      return nil, err
+   }
+   return &widevineDevice{ClientId: client_id, PrivateKey: pem_data}, nil
+}
+
+// parseWvd decodes a WVD device file. Version 1 files carry a trailing VMP
+// blob, which is ignored.
+func parseWvd(data []byte) (*widevineDevice, error) {
+   if len(data) < 7 || string(data[:3]) != "WVD" {
+      return nil, errors.New("missing WVD signature")
+   }
+   version := data[3]
+   if version != 1 && version != 2 {
+      return nil, fmt.Errorf("unsupported WVD version %d", version)
+   }
+   device := &widevineDevice{Type: data[4], SecurityLevel: data[5]}
+   // data[6] holds flags, which are reserved
+   data = data[7:]
+
+   privateKey, data, err := readWvdField(data)
+   if err != nil {
+      return nil, fmt.Errorf("private key: %w", err)
+   }
+   device.PrivateKey = pem.EncodeToMemory(&pem.Block{
+      Type: "RSA PRIVATE KEY", Bytes: privateKey,
+   })
+
+   device.ClientId, _, err = readWvdField(data)
+   if err != nil {
+      return nil, fmt.Errorf("client ID: %w", err)
+   }
+   return device, nil
+}
+
+// readWvdField reads a field prefixed with its 16-bit length.
+func readWvdField(data []byte) ([]byte, []byte, error) {
+   if len(data) < 2 {
+      return nil, nil, errors.New("truncated length")
+   }
+   size := int(binary.BigEndian.Uint16(data))
+   data = data[2:]
+   if size == 0 || size > len(data) {
+      return nil, nil, errors.New("truncated field")
+   }
+   return data[:size], data[size:], nil
+}
+
+// wvd.go
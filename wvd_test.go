@@ -0,0 +1,58 @@
+package maya
+
+import (
+   "bytes"
+   "encoding/binary"
+   "encoding/pem"
+   "testing"
+)
+
+// wvdFile encodes a WVD file of the given version.
+func wvdFile(version byte, privateKey, clientId []byte) []byte {
+   data := []byte{'W', 'V', 'D', version, 2, 3, 0}
+   data = binary.BigEndian.AppendUint16(data, uint16(len(privateKey)))
+   data = append(data, privateKey...)
+   data = binary.BigEndian.AppendUint16(data, uint16(len(clientId)))
+   return append(data, clientId...)
+}
+
+func TestParseWvd(t *testing.T) {
+   privateKey, clientId := []byte("private key"), []byte("client id")
+   for _, version := range []byte{1, 2} {
+      data := wvdFile(version, privateKey, clientId)
+      if version == 1 {
+         data = append(data, 0, 3, 'v', 'm', 'p')
+      }
+      device, err := parseWvd(data)
+      if err != nil {
+         t.Fatalf("version %d: %v", version, err)
+      }
+      if device.Type != 2 || device.SecurityLevel != 3 {
+         t.Errorf("version %d: type %d, security level %d", version, device.Type, device.SecurityLevel)
+      }
+      if !bytes.Equal(device.ClientId, clientId) {
+         t.Errorf("version %d: client ID = %q", version, device.ClientId)
+      }
+      block, _ := pem.Decode(device.PrivateKey)
+      if block == nil || block.Type != "RSA PRIVATE KEY" || !bytes.Equal(block.Bytes, privateKey) {
+         t.Errorf("version %d: private key = %q", version, device.PrivateKey)
+      }
+   }
+}
+
+func TestParseWvdErrors(t *testing.T) {
+   valid := wvdFile(2, []byte("key"), []byte("client"))
+   tests := map[string][]byte{
+      "signature": append([]byte("XVD"), valid[3:]...),
+      "version":   append([]byte("WVD\x03"), valid[4:]...),
+      "truncated": valid[:len(valid)-1],
+      "short":     valid[:5],
+   }
+   for name, data := range tests {
+      if _, err := parseWvd(data); err == nil {
+         t.Errorf("%s: no error", name)
+      }
+   }
+}
+
+// wvd_test.go